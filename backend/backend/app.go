@@ -2,10 +2,12 @@ package backend
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -26,9 +28,12 @@ func NewApp(modelPool *ModelPool) *App {
 }
 
 func (a *App) initializeRoutes() {
+	a.Router.HandleFunc("/datasets", a.datasets).Methods("GET")
 	a.Router.HandleFunc("/vitals", a.vitals).Methods("GET")
 	a.Router.HandleFunc("/stations", a.stations).Methods("GET")
+	a.Router.HandleFunc("/stations/{id}/history", a.stationHistory).Methods("GET")
 	a.Router.HandleFunc("/journey_query", a.journeyQuery).Methods("GET")
+	a.Router.HandleFunc("/rebalance_query", a.rebalanceQuery).Methods("GET")
 }
 
 func (a *App) Run(addr string) {
@@ -38,8 +43,56 @@ func (a *App) Run(addr string) {
 	log.Fatal(http.ListenAndServe(addr, handlers.CORS(originsOk)(a.Router)))
 }
 
-func (a *App) vitals(w http.ResponseWriter, _ *http.Request) {
-	m := a.ModelPool.Get()
+// model returns a Model of the dataset named by the request's dataset
+// parameter, or DefaultDataset. If the dataset is unknown, it responds with an
+// error and returns nil.
+func (a *App) model(w http.ResponseWriter, r *http.Request) *Model {
+	dataset := r.FormValue("dataset")
+	if dataset == "" {
+		return a.ModelPool.Get(DefaultDataset)
+	}
+	ds, err := a.ModelPool.Datasets()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return nil
+	}
+	if !contains(ds, dataset) {
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Unknown dataset: %q", dataset))
+		return nil
+	}
+	return a.ModelPool.Get(dataset)
+}
+
+type datasetVitals struct {
+	Id     string
+	Vitals *Vitals `json:",omitempty"`
+	Error  string  `json:",omitempty"`
+}
+
+func (a *App) datasets(w http.ResponseWriter, _ *http.Request) {
+	ds, err := a.ModelPool.Datasets()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	v := make([]datasetVitals, len(ds))
+	for i, d := range ds {
+		v[i].Id = d
+		m := a.ModelPool.Get(d)
+		// One broken dataset should not hide the others.
+		if v[i].Vitals, err = m.Vitals(); err != nil {
+			v[i].Error = err.Error()
+		}
+		m.Close()
+	}
+	respondWithJSON(w, http.StatusOK, v)
+}
+
+func (a *App) vitals(w http.ResponseWriter, r *http.Request) {
+	m := a.model(w, r)
+	if m == nil {
+		return
+	}
 	defer m.Close()
 	v, err := m.Vitals()
 	if err != nil {
@@ -49,8 +102,11 @@ func (a *App) vitals(w http.ResponseWriter, _ *http.Request) {
 	respondWithJSON(w, http.StatusOK, v)
 }
 
-func (a *App) stations(w http.ResponseWriter, _ *http.Request) {
-	m := a.ModelPool.Get()
+func (a *App) stations(w http.ResponseWriter, r *http.Request) {
+	m := a.model(w, r)
+	if m == nil {
+		return
+	}
 	defer m.Close()
 	v, err := m.GetStations()
 	if err != nil {
@@ -60,38 +116,145 @@ func (a *App) stations(w http.ResponseWriter, _ *http.Request) {
 	respondWithJSON(w, http.StatusOK, v)
 }
 
+// parseCircles parses the src_ and dst_ circle parameters of a query.
+func parseCircles(r *http.Request) (src, dst Circle, err error) {
+	for _, p := range []struct {
+		name string
+		v    *float64
+	}{
+		{"src_lat", &src.Center.Lat}, {"src_long", &src.Center.Long}, {"src_radius", &src.RadiusKm},
+		{"dst_lat", &dst.Center.Lat}, {"dst_long", &dst.Center.Long}, {"dst_radius", &dst.RadiusKm},
+	} {
+		if *p.v, err = strconv.ParseFloat(r.FormValue(p.name), 64); err != nil {
+			return src, dst, fmt.Errorf("Invalid %v: %v", p.name, err)
+		}
+	}
+	return src, dst, nil
+}
+
+func (a *App) stationHistory(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	m := a.model(w, r)
+	if m == nil {
+		return
+	}
+	defer m.Close()
+	v, err := m.StationHistory(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if v == nil {
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("No history of station %q", id))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, v)
+}
+
 func (a *App) journeyQuery(w http.ResponseWriter, r *http.Request) {
-	var src, dst Circle
-	var err error
+	src, dst, err := parseCircles(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	if src.Center.Lat, err = strconv.ParseFloat(r.FormValue("src_lat"), 64); err != nil {
-		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid src_lat: %v", err))
+	var opts JourneyOptions
+	if rt := r.FormValue("rider_type"); rt != "" && rt != "all" {
+		if !contains(RiderTypes, rt) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid rider_type: %q", rt))
+			return
+		}
+		opts.RiderType = rt
+	}
+	if rt := r.FormValue("rideable_type"); rt != "" && rt != "all" {
+		if !contains(RideableTypes, rt) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid rideable_type: %q", rt))
+			return
+		}
+		opts.RideableType = rt
+	}
+	if opts.RiderType != "" && opts.RideableType != "" {
+		respondWithError(w, http.StatusBadRequest, "Only one of rider_type and rideable_type may be set")
 		return
 	}
-	if src.Center.Long, err = strconv.ParseFloat(r.FormValue("src_long"), 64); err != nil {
-		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid src_long: %v", err))
+	// The year range of the hour-of-week counts, inclusive.
+	for _, y := range []struct {
+		param string
+		year  *int
+	}{{"from", &opts.FromYear}, {"to", &opts.ToYear}} {
+		v := r.FormValue(y.param)
+		if v == "" {
+			continue
+		}
+		if *y.year, err = strconv.Atoi(v); err != nil || len(v) != 4 {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid %v: %q is not a year", y.param, v))
+			return
+		}
+	}
+	if opts.FromYear != 0 && opts.ToYear != 0 && opts.FromYear > opts.ToYear {
+		respondWithError(w, http.StatusBadRequest, "from must not be after to")
 		return
 	}
-	if src.RadiusKm, err = strconv.ParseFloat(r.FormValue("src_radius"), 64); err != nil {
-		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid src_radius: %v", err))
+	switch s := r.FormValue("series"); s {
+	case "":
+	case "monthly":
+		opts.Monthly = true
+	default:
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid series: %q", s))
 		return
 	}
-	if dst.Center.Lat, err = strconv.ParseFloat(r.FormValue("dst_lat"), 64); err != nil {
-		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid dst_lat: %v", err))
+	// The breakdown is a comma-separated list of dimensions.
+	if b := r.FormValue("breakdown"); b != "" {
+		for _, d := range strings.Split(b, ",") {
+			switch d {
+			case "rider_type":
+				opts.ByRiderType = true
+			case "rideable_type":
+				opts.ByRideableType = true
+			default:
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid breakdown: %q", d))
+				return
+			}
+		}
+	}
+
+	if (opts.FromYear != 0 || opts.ToYear != 0) &&
+		(opts.RiderType != "" || opts.RideableType != "" || opts.ByRiderType || opts.ByRideableType) {
+		respondWithError(w, http.StatusBadRequest, "from and to cannot be combined with a type filter or breakdown")
 		return
 	}
-	if dst.Center.Long, err = strconv.ParseFloat(r.FormValue("dst_long"), 64); err != nil {
-		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid dst_long: %v", err))
+
+	m := a.model(w, r)
+	if m == nil {
 		return
 	}
-	if dst.RadiusKm, err = strconv.ParseFloat(r.FormValue("dst_radius"), 64); err != nil {
-		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid dst_radius: %v", err))
+	defer m.Close()
+	v, err := m.JourneyQuery(src, dst, opts)
+	if errors.Is(err, errNoYearCounts) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, v)
+}
 
-	m := a.ModelPool.Get()
+func (a *App) rebalanceQuery(w http.ResponseWriter, r *http.Request) {
+	src, dst, err := parseCircles(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	m := a.model(w, r)
+	if m == nil {
+		return
+	}
 	defer m.Close()
-	v, err := m.JourneyQuery(src, dst)
+	v, err := m.RebalanceQuery(src, dst)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -100,6 +263,15 @@ func (a *App) journeyQuery(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, v)
 }
 
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
 func respondWithError(w http.ResponseWriter, code int, message string) {
 	respondWithJSON(w, code, map[string]string{"error": message})
 }
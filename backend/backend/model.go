@@ -1,10 +1,13 @@
 package backend
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	rg "github.com/RedisGraph/redisgraph-go"
@@ -14,7 +17,7 @@ import (
 // A ModelPool is used to create cheap Model structs used per request.
 type ModelPool struct {
 	connPool                  redis.Pool
-	journeyQueryStringBuilder func(src, dst Circle) string
+	journeyQueryStringBuilder func(rel string, src, dst Circle, props []vectorProp) string
 }
 
 func NewModelPool(address string) (*ModelPool, error) {
@@ -35,30 +38,98 @@ func (mp *ModelPool) Close() error {
 type Model struct {
 	conn                      redis.Conn
 	graph                     rg.Graph
-	journeyQueryStringBuilder func(src, dst Circle) string
+	dataset                   string
+	graphName                 string
+	journeyQueryStringBuilder func(rel string, src, dst Circle, props []vectorProp) string
 }
 
-// Returns a new Model to be used by a request. Close() should be
-// called on the Model before the request ends.
-func (mp *ModelPool) Get() *Model {
-	m := &Model{}
+// The graph built before versioned graphs, whose keys are not prefixed.
+const legacyGraph = "journeys"
+
+// DefaultDataset is the dataset served if a request names none: all of Citi
+// Bike, whose keys are not prefixed.
+const DefaultDataset = "citibike"
+
+// datasetKey names a key of a dataset, such as its ACTIVE_GRAPH.
+func datasetKey(dataset, name string) string {
+	if dataset == DefaultDataset {
+		return name
+	}
+	return dataset + ":" + name
+}
+
+// baseGraph is the graph of a dataset served until a version is activated.
+func baseGraph(dataset string) string {
+	if dataset == DefaultDataset {
+		return legacyGraph
+	}
+	return dataset
+}
+
+// Returns a new Model of a dataset to be used by a request. Close() should be
+// called on the Model before the request ends. The Model reads the graph
+// named by the dataset's ACTIVE_GRAPH, which the importer flips once a new
+// version is built.
+func (mp *ModelPool) Get(dataset string) *Model {
+	m := &Model{dataset: dataset}
 	m.conn = mp.connPool.Get()
-	m.graph = rg.GraphNew("journeys", m.conn)
+	var err error
+	activeKey := datasetKey(dataset, "ACTIVE_GRAPH")
+	if m.graphName, err = redis.String(m.conn.Do("GET", activeKey)); err != nil {
+		if err != redis.ErrNil {
+			log.Printf("Failed to read %v: %v", activeKey, err)
+		}
+		m.graphName = baseGraph(dataset)
+	}
+	m.graph = rg.GraphNew(m.graphName, m.conn)
 	m.journeyQueryStringBuilder = mp.journeyQueryStringBuilder
 	return m
 }
 
+// Datasets returns the ids of the datasets built by the importer, sorted,
+// always including DefaultDataset.
+func (mp *ModelPool) Datasets() ([]string, error) {
+	conn := mp.connPool.Get()
+	defer conn.Close()
+	ds, err := redis.Strings(conn.Do("SMEMBERS", "DATASETS"))
+	if err != nil {
+		return nil, err
+	}
+	if !contains(ds, DefaultDataset) {
+		ds = append(ds, DefaultDataset)
+	}
+	sort.Strings(ds)
+	return ds, nil
+}
+
 func (m *Model) Close() error {
 	return m.conn.Close()
 }
 
+// key returns the name of a Redis key of the active graph version.
+func (m *Model) key(name string) string {
+	if m.graphName == legacyGraph {
+		return name
+	}
+	return m.graphName + ":" + name
+}
+
 type Vitals struct {
+	Dataset                            string
+	Graph                              string
 	TripCount, StationCount, EdgeCount int
 	MemoryUsageHuman                   string
+	// The number of CSV rows the importer rejected, by reason.
+	RejectedRows map[string]int
+	// The number of trips of each rideable type, or "unknown" for exports
+	// which do not record it.
+	RideableTypes map[string]int
+	// How trips are bucketed into the counts of the :Trip edges.
+	Buckets *BucketConvention
 }
 
 func (m *Model) Vitals() (*Vitals, error) {
-	var v Vitals
+	v := Vitals{Dataset: m.dataset, Graph: m.graphName}
 	var err error
 	if v.TripCount, err = m.TripCount(); err != nil {
 		if err == redis.ErrNil {
@@ -76,11 +147,20 @@ func (m *Model) Vitals() (*Vitals, error) {
 	if v.MemoryUsageHuman, err = m.MemoryUsageHuman(); err != nil {
 		return nil, err
 	}
+	if v.RejectedRows, err = m.RejectedRows(); err != nil {
+		return nil, err
+	}
+	if v.RideableTypes, err = m.RideableTypes(); err != nil {
+		return nil, err
+	}
+	if v.Buckets, err = m.Buckets(); err != nil {
+		return nil, err
+	}
 	return &v, nil
 }
 
 func (m *Model) TripCount() (int, error) {
-	return redis.Int(m.conn.Do("GET", "trips"))
+	return redis.Int(m.conn.Do("GET", m.key("trips")))
 }
 
 func (m *Model) StationCount() (int, error) {
@@ -105,6 +185,98 @@ func (m *Model) EdgeCount() (int, error) {
 	return r.Record().GetByIndex(0).(int), nil
 }
 
+// A FileReport is the importer's summary of one archive, from FILE_REPORTS.
+type FileReport struct {
+	File          string
+	Rows, Trips   int
+	Rejected      map[string]int
+	RideableTypes map[string]int
+}
+
+func (m *Model) FileReports() ([]FileReport, error) {
+	values, err := redis.Strings(m.conn.Do("HVALS", m.key("FILE_REPORTS")))
+	if err != nil {
+		return nil, err
+	}
+	var result []FileReport
+	for _, v := range values {
+		var fr FileReport
+		if err := json.Unmarshal([]byte(v), &fr); err != nil {
+			return nil, err
+		}
+		result = append(result, fr)
+	}
+	return result, nil
+}
+
+func (m *Model) RejectedRows() (map[string]int, error) {
+	reports, err := m.FileReports()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]int)
+	for _, fr := range reports {
+		for reason, n := range fr.Rejected {
+			result[reason] += n
+		}
+	}
+	return result, nil
+}
+
+// A BucketConvention is the importer's description of the counts of the :Trip
+// edges, from BUCKETS. Buckets of "hour_of_week" are indexed by day*24 + hour,
+// where day 0 is FirstDay, in the wall clock hours of TimeZone.
+type BucketConvention struct {
+	Buckets  string
+	FirstDay string
+	TimeZone string
+	// The upper bounds of the :Trip edges' durations buckets, in seconds.
+	DurationBounds []int `json:",omitempty"`
+	// The month of element 0 of the :Trip edges' months series, as "2006-01".
+	FirstMonth string `json:",omitempty"`
+	// If YearCounts is true, each year from FirstMonth is also counted by hour
+	// of week in counts_y<year>.
+	YearCounts bool `json:",omitempty"`
+}
+
+// Graphs imported before BUCKETS was recorded were bucketed by the wall clock
+// times of the trip data, starting on Sunday.
+var legacyBuckets = BucketConvention{Buckets: "hour_of_week", FirstDay: "Sunday", TimeZone: "America/New_York"}
+
+func (m *Model) Buckets() (*BucketConvention, error) {
+	v, err := redis.Bytes(m.conn.Do("GET", m.key("BUCKETS")))
+	if err == redis.ErrNil {
+		b := legacyBuckets
+		return &b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var b BucketConvention
+	if err := json.Unmarshal(v, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (m *Model) RideableTypes() (map[string]int, error) {
+	reports, err := m.FileReports()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]int)
+	for _, fr := range reports {
+		if fr.RideableTypes == nil {
+			// Imported before rideable types were recorded.
+			result["unknown"] += fr.Trips
+		}
+		for t, n := range fr.RideableTypes {
+			result[t] += n
+		}
+	}
+	return result, nil
+}
+
 func (m *Model) MemoryUsageHuman() (string, error) {
 	info, err := redis.String(m.conn.Do("INFO", "memory"))
 	if err != nil {
@@ -122,84 +294,435 @@ type Coord struct {
 	Lat, Long float64
 }
 
-func (m *Model) GetStations() ([]Coord, error) {
+// A Station is serialised with its Coord fields inline, so /stations remains
+// a list of {Lat, Long} objects.
+type Station struct {
+	Id string
+	Coord
+}
+
+func (m *Model) GetStations() ([]Station, error) {
 	// WARN: For redisgraph-so to understand RETURNING a point,
 	// https://github.com/RedisGraph/redisgraph-go/pull/45 is required.
 	res, err := m.graph.Query(
-		"MATCH (s:Station) RETURN s.loc")
+		"MATCH (s:Station) RETURN s.id, s.loc")
 	if err != nil {
 		return nil, err
 	}
-	var result []Coord
+	var result []Station
 	for res.Next() {
 		r := res.Record()
-		pos := r.GetByIndex(0).(map[string]float64)
-		result = append(result, Coord{pos["latitude"], pos["longitude"]})
+		// Station ids are strings, but graphs imported before the modern
+		// Citi Bike schema stored integers.
+		id := fmt.Sprint(r.GetByIndex(0))
+		pos := r.GetByIndex(1).(map[string]float64)
+		result = append(result, Station{id, Coord{pos["latitude"], pos["longitude"]}})
 	}
 	return result, nil
 }
 
+// A StationVersion is a name and location a station was seen with by the
+// importer, and when.
+type StationVersion struct {
+	Name        string
+	Lat, Long   float64
+	First, Last time.Time
+	// The number of trips which saw the version in each month, as "2006-01".
+	Months map[string]int `json:",omitempty"`
+}
+
+// StationHistory returns the versions of a station, by when they were first
+// seen, from STATION_HISTORY. It returns nil if the station has no
+// history, e.g. in graphs imported before it was kept.
+func (m *Model) StationHistory(id string) ([]StationVersion, error) {
+	v, err := redis.Bytes(m.conn.Do("HGET", m.key("STATION_HISTORY"), id))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []StationVersion
+	if err := json.Unmarshal(v, &versions); err != nil {
+		return nil, err
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].First.Before(versions[j].First)
+	})
+	return versions, nil
+}
+
 type Circle struct {
 	Center   Coord
 	RadiusKm float64
 }
 
-type JourneyData struct {
+// JourneyOptions filter and break down the trips of a JourneyQuery. At most
+// one of RiderType and RideableType may be set.
+type JourneyOptions struct {
+	// If set, only trips by this rider type ("member" or "casual") are counted.
+	RiderType string
+	// If set, only trips on this rideable type (e.g. "electric_bike") are
+	// counted.
+	RideableType string
+	// If true, the counts of each rider type are also returned.
+	ByRiderType bool
+	// If true, the counts of each rideable type are also returned.
+	ByRideableType bool
+	// If non-zero, the hour-of-week counts are only of trips starting from
+	// FromYear, or until the end of ToYear. A year range cannot be combined
+	// with a type filter or breakdown.
+	FromYear, ToYear int
+	// If true, the counts by calendar month and by month of year are also
+	// returned.
+	Monthly bool
+}
+
+// The rider and rideable types. The trips of each are counted by a
+// counts_<type> property of the :Trip edges.
+var (
+	RiderTypes    = []string{"member", "casual"}
+	RideableTypes = []string{"classic_bike", "electric_bike", "docked_bike"}
+)
+
+func typeProp(t string) string {
+	return "counts_" + t
+}
+
+func yearProp(year int) string {
+	return fmt.Sprintf("counts_y%d", year)
+}
+
+// JourneyCounts are the hour-of-week trip counts in each direction.
+type JourneyCounts struct {
 	Egress, Ingress []int
-	RunTimeMs       float64
 }
 
-func journeyQueryStringBuilder() func(src, dst Circle) string {
-	// Build a long Graph query which returns a sum every hour in the week.
-	// Initially, I used a consise UNWIND query, but in benchmarking this
-	// manually-unwound approach was consistently faster.
-	var parts strings.Builder
-	parts.WriteString(
-		`MATCH (src:Station)<-[t:Trip]->(dst:Station)
-		 WHERE distance(src.loc, point({latitude: %f, longitude: %f})) < %f
-		 AND distance(dst.loc, point({latitude: %f, longitude: %f})) < %f
-		 RETURN (startNode(t) = src)`)
-	for i := 0; i < (24 * 7); i++ {
-		parts.WriteString(fmt.Sprintf(", sum(t.counts[%d])", i))
-	}
-	queryStringtmpl := parts.String()
+// A DurationHistogram counts trips by duration bucket. Median and P90 are
+// interpolated within their buckets, in seconds.
+type DurationHistogram struct {
+	Counts      []int
+	Median, P90 int
+}
+
+// JourneyDurations are the trip duration histograms in each direction, of all
+// rider types. Bucket i counts trips shorter than Bounds[i] seconds, and the
+// last bucket counts longer trips.
+type JourneyDurations struct {
+	Bounds          []int
+	Egress, Ingress DurationHistogram
+}
+
+// A JourneySeries is the trip counts in each direction by calendar month,
+// starting at FirstMonth, and by month of year, starting in January.
+type JourneySeries struct {
+	FirstMonth  string
+	Months      JourneyCounts
+	MonthOfYear JourneyCounts
+}
+
+type JourneyData struct {
+	JourneyCounts
+	// The counts of each rider type and rideable type, if requested.
+	RiderTypes    map[string]*JourneyCounts `json:",omitempty"`
+	RideableTypes map[string]*JourneyCounts `json:",omitempty"`
+	// If requested.
+	Monthly *JourneySeries `json:",omitempty"`
+	// Omitted if the graph has no durations.
+	Durations *JourneyDurations `json:",omitempty"`
+	RunTimeMs float64
+}
+
+// A vectorProp is summed by a journey query. If it names several :Trip edge
+// properties, they are added elementwise first.
+type vectorProp struct {
+	names []string
+	size  int
+}
 
-	return func(src, dst Circle) string {
+func newVectorProp(name string, size int) vectorProp {
+	return vectorProp{[]string{name}, size}
+}
+
+func journeyQueryStringBuilder() func(rel string, src, dst Circle, props []vectorProp) string {
+	// Build a long Graph query which returns a sum of every element of each
+	// property, e.g. every hour in the week. Initially, I used a consise
+	// UNWIND query, but in benchmarking this manually-unwound approach was
+	// consistently faster. Templates are cached by their edge type and
+	// properties.
+	var templates sync.Map
+	return func(rel string, src, dst Circle, props []vectorProp) string {
+		key := rel + fmt.Sprint(props)
+		tmpl, ok := templates.Load(key)
+		if !ok {
+			var parts strings.Builder
+			parts.WriteString(
+				`MATCH (src:Station)<-[t:` + rel + `]->(dst:Station)
+				 WHERE distance(src.loc, point({latitude: %f, longitude: %f})) < %f
+				 AND distance(dst.loc, point({latitude: %f, longitude: %f})) < %f
+				 RETURN (startNode(t) = src)`)
+			for _, p := range props {
+				for i := 0; i < p.size; i++ {
+					if len(p.names) == 1 {
+						parts.WriteString(fmt.Sprintf(", sum(t.%v[%d])", p.names[0], i))
+						continue
+					}
+					// An edge lacks the properties of years without trips.
+					var terms []string
+					for _, name := range p.names {
+						terms = append(terms, fmt.Sprintf("coalesce(t.%v[%d], 0)", name, i))
+					}
+					parts.WriteString(", sum(" + strings.Join(terms, " + ") + ")")
+				}
+			}
+			tmpl, _ = templates.LoadOrStore(key, parts.String())
+		}
 		return fmt.Sprintf(
-			queryStringtmpl,
+			tmpl.(string),
 			src.Center.Lat, src.Center.Long, src.RadiusKm*1000,
 			dst.Center.Lat, dst.Center.Long, dst.RadiusKm*1000)
 	}
 }
 
-func (m *Model) JourneyQuery(src, dst Circle) (*JourneyData, error) {
-	res, err := m.graph.Query(m.journeyQueryStringBuilder(src, dst))
+func (m *Model) JourneyQuery(src, dst Circle, opts JourneyOptions) (*JourneyData, error) {
+	buckets, err := m.Buckets()
+	if err != nil {
+		return nil, err
+	}
+	yearRange := opts.FromYear != 0 || opts.ToYear != 0
+	props := []vectorProp{newVectorProp("counts", 24*7)}
+	switch {
+	case opts.RiderType != "" && opts.RideableType != "":
+		return nil, errors.New("cannot filter by both rider type and rideable type")
+	case yearRange && (opts.RiderType != "" || opts.RideableType != "" || opts.ByRiderType || opts.ByRideableType):
+		return nil, errors.New("cannot filter or break down a year range by type")
+	case opts.RiderType != "":
+		props[0] = newVectorProp(typeProp(opts.RiderType), 24*7)
+	case opts.RideableType != "":
+		props[0] = newVectorProp(typeProp(opts.RideableType), 24*7)
+	case yearRange:
+		years, err := buckets.years(opts.FromYear, opts.ToYear)
+		if err != nil {
+			return nil, err
+		}
+		props[0].names = years
+	}
+	if opts.ByRiderType {
+		for _, rt := range RiderTypes {
+			props = append(props, newVectorProp(typeProp(rt), 24*7))
+		}
+	}
+	if opts.ByRideableType {
+		for _, rt := range RideableTypes {
+			props = append(props, newVectorProp(typeProp(rt), 24*7))
+		}
+	}
+	if opts.Monthly {
+		months, err := buckets.months()
+		if err != nil {
+			return nil, err
+		}
+		props = append(props, newVectorProp("months", months), newVectorProp("month_of_year", 12))
+	}
+	if len(buckets.DurationBounds) > 0 {
+		props = append(props, newVectorProp("durations", len(buckets.DurationBounds)+1))
+	}
+	counts, runTimeMs, err := m.sumEdges("Trip", src, dst, props)
+	if err != nil {
+		return nil, err
+	}
+	data := &JourneyData{JourneyCounts: counts[0]}
+	next := 1
+	breakdown := func(types []string) map[string]*JourneyCounts {
+		result := make(map[string]*JourneyCounts)
+		for _, t := range types {
+			result[t] = &counts[next]
+			next++
+		}
+		return result
+	}
+	if opts.ByRiderType {
+		data.RiderTypes = breakdown(RiderTypes)
+	}
+	if opts.ByRideableType {
+		data.RideableTypes = breakdown(RideableTypes)
+	}
+	if opts.Monthly {
+		data.Monthly = &JourneySeries{
+			FirstMonth:  buckets.FirstMonth,
+			Months:      trimMonths(counts[next]),
+			MonthOfYear: counts[next+1],
+		}
+		next += 2
+	}
+	if len(buckets.DurationBounds) > 0 {
+		d := counts[next]
+		data.Durations = &JourneyDurations{
+			Bounds:  buckets.DurationBounds,
+			Egress:  newDurationHistogram(d.Egress, buckets.DurationBounds),
+			Ingress: newDurationHistogram(d.Ingress, buckets.DurationBounds),
+		}
+	}
+	data.RunTimeMs = runTimeMs
+	return data, nil
+}
+
+// RebalanceData are the hour-of-week counts of inferred rebalancing moves in
+// each direction.
+type RebalanceData struct {
+	JourneyCounts
+	RunTimeMs float64
+}
+
+// RebalanceQuery sums the :Rebalance edges between two circles, as
+// JourneyQuery sums the :Trip edges. Each counts a bike which ended a trip at
+// one station, and started its next trip at another.
+func (m *Model) RebalanceQuery(src, dst Circle) (*RebalanceData, error) {
+	counts, runTimeMs, err := m.sumEdges("Rebalance", src, dst, []vectorProp{newVectorProp("counts", 24*7)})
 	if err != nil {
 		return nil, err
 	}
-	data := &JourneyData{}
+	return &RebalanceData{JourneyCounts: counts[0], RunTimeMs: runTimeMs}, nil
+}
+
+// sumEdges sums each property of the rel edges between two circles, in each
+// direction. It also returns the query's run time.
+func (m *Model) sumEdges(rel string, src, dst Circle, props []vectorProp) ([]JourneyCounts, float64, error) {
+	res, err := m.graph.Query(m.journeyQueryStringBuilder(rel, src, dst, props))
+	if err != nil {
+		return nil, 0, err
+	}
+	counts := make([]JourneyCounts, len(props))
 	for res.Next() {
 		r := res.Record()
-		var counts []int
-		for _, v := range r.Values()[1:] {
-			// The query's sum(t.count[i]) returns a float for some reason.
-			c := int(v.(float64))
-			counts = append(counts, c)
+		values := r.Values()[1:]
+		for p, prop := range props {
+			var c []int
+			for _, v := range values[:prop.size] {
+				// The query's sum(t.counts[i]) returns a float for some reason,
+				// or nil if the edges lack the property.
+				n, _ := v.(float64)
+				c = append(c, int(n))
+			}
+			values = values[prop.size:]
+			if r.GetByIndex(0).(bool) {
+				counts[p].Egress = c
+			} else {
+				counts[p].Ingress = c
+			}
+		}
+	}
+	for p, prop := range props {
+		// Sometimes ingress, egress, or both, can be empty.
+		if len(counts[p].Egress) == 0 {
+			counts[p].Egress = make([]int, prop.size)
 		}
-		if r.GetByIndex(0).(bool) {
-			data.Egress = counts
-		} else {
-			data.Ingress = counts
+		if len(counts[p].Ingress) == 0 {
+			counts[p].Ingress = make([]int, prop.size)
 		}
 	}
-	// Sometimes ingress, egress, or both, can be empty.
-	if len(data.Egress) == 0 {
-		data.Egress = make([]int, 24*7)
+	// Returning runtime is helpful to show off performance. :)
+	return counts, res.InternalExecutionTime(), nil
+}
+
+// firstMonth parses FirstMonth, in the graph's time zone.
+func (b *BucketConvention) firstMonth() (time.Time, *time.Location, error) {
+	if b.FirstMonth == "" {
+		return time.Time{}, nil, errors.New("the graph has no monthly counts; reimport it")
 	}
-	if len(data.Ingress) == 0 {
-		data.Ingress = make([]int, 24*7)
+	loc, err := time.LoadLocation(b.TimeZone)
+	if err != nil {
+		return time.Time{}, nil, err
 	}
-	// Returning runtime is helpful to show off performance. :)
-	data.RunTimeMs = res.InternalExecutionTime()
-	return data, nil
+	first, err := time.ParseInLocation("2006-01", b.FirstMonth, loc)
+	return first, loc, err
+}
+
+// errNoYearCounts is returned for a year range of a graph imported without
+// --year_counts.
+var errNoYearCounts = errors.New("the graph has no yearly counts; reimport it with --year_counts")
+
+// years returns the counts_y<year> properties from one year to another,
+// inclusive. Zero is the first or current year.
+func (b *BucketConvention) years(from, to int) ([]string, error) {
+	if !b.YearCounts {
+		return nil, errNoYearCounts
+	}
+	first, loc, err := b.firstMonth()
+	if err != nil {
+		return nil, err
+	}
+	if from == 0 || from < first.Year() {
+		from = first.Year()
+	}
+	if now := time.Now().In(loc).Year(); to == 0 || to > now {
+		to = now
+	}
+	if from > to {
+		return nil, fmt.Errorf("the graph has no trips from %d to %d", from, to)
+	}
+	var props []string
+	for y := from; y <= to; y++ {
+		props = append(props, yearProp(y))
+	}
+	return props, nil
+}
+
+// months returns the length of the months series, up to the current month.
+func (b *BucketConvention) months() (int, error) {
+	first, loc, err := b.firstMonth()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().In(loc)
+	return (now.Year()-first.Year())*12 + int(now.Month()-first.Month()) + 1, nil
+}
+
+// trimMonths drops the trailing months without trips in either direction,
+// such as those not yet imported.
+func trimMonths(c JourneyCounts) JourneyCounts {
+	n := len(c.Egress)
+	for n > 0 && c.Egress[n-1] == 0 && c.Ingress[n-1] == 0 {
+		n--
+	}
+	return JourneyCounts{Egress: c.Egress[:n], Ingress: c.Ingress[:n]}
+}
+
+func newDurationHistogram(counts, bounds []int) DurationHistogram {
+	return DurationHistogram{
+		Counts: counts,
+		Median: durationQuantile(counts, bounds, 0.5),
+		P90:    durationQuantile(counts, bounds, 0.9),
+	}
+}
+
+// durationQuantile estimates the q quantile of a duration histogram, in
+// seconds, interpolating linearly within its bucket. Quantiles in the last,
+// unbounded, bucket are its lower bound.
+func durationQuantile(counts, bounds []int, q float64) int {
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	seen := 0
+	for i, c := range counts {
+		if c == 0 || float64(seen+c) < rank {
+			seen += c
+			continue
+		}
+		lower := 0
+		if i > 0 {
+			lower = bounds[i-1]
+		}
+		if i == len(bounds) {
+			return lower
+		}
+		frac := (rank - float64(seen)) / float64(c)
+		return lower + int(frac*float64(bounds[i]-lower))
+	}
+	return bounds[len(bounds)-1]
 }
@@ -0,0 +1,46 @@
+package backend
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDurationQuantile(t *testing.T) {
+	bounds := []int{60, 120, 300}
+	tests := []struct {
+		name   string
+		counts []int
+		q      float64
+		want   int
+	}{
+		{"empty histogram", []int{0, 0, 0, 0}, 0.5, 0},
+		{"no buckets", nil, 0.9, 0},
+		{"first bucket", []int{10, 0, 0, 0}, 0.5, 30},
+		{"first bucket, low quantile", []int{8, 2, 0, 0}, 0.1, 7},
+		{"middle bucket", []int{2, 0, 6, 2}, 0.5, 210},
+		{"upper bound of a bucket", []int{0, 4, 4, 0}, 0.5, 120},
+		{"unbounded last bucket", []int{1, 0, 0, 9}, 0.9, 300},
+		{"only the unbounded last bucket", []int{0, 0, 0, 5}, 0.5, 300},
+	}
+	for _, tt := range tests {
+		if got := durationQuantile(tt.counts, bounds, tt.q); got != tt.want {
+			t.Errorf("%v: durationQuantile(%v, %v) = %v, want %v", tt.name, tt.counts, tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestYears(t *testing.T) {
+	b := BucketConvention{TimeZone: "America/New_York", FirstMonth: "2013-01"}
+	if _, err := b.years(2019, 2020); !errors.Is(err, errNoYearCounts) {
+		t.Errorf("got %v for a graph without year counts, want %v", err, errNoYearCounts)
+	}
+	b.YearCounts = true
+	years, err := b.years(2019, 2020)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"counts_y2019", "counts_y2020"}; !reflect.DeepEqual(years, want) {
+		t.Errorf("got %v, want %v", years, want)
+	}
+}
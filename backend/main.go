@@ -12,7 +12,7 @@ import (
 )
 
 func PrintVitals(mp *backend.ModelPool) {
-	m := mp.Get()
+	m := mp.Get(backend.DefaultDataset)
 	defer m.Close()
 
 	// On start up, keep polling on LOADING errors.
@@ -4,6 +4,6 @@ go 1.16
 
 require (
 	github.com/gomodule/redigo v1.8.4
-	github.com/olekukonko/tablewriter v0.0.5 // indirect
+	github.com/olekukonko/tablewriter v0.0.5
 	github.com/redislabs/redisgraph-go v2.0.2+incompatible
 )
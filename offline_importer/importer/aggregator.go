@@ -0,0 +1,289 @@
+package importer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The number of hour-of-week buckets in a :Trip edge's counts.
+const hoursPerWeek = 24 * 7
+
+// The day of the week of the first 24 hour-of-week buckets.
+const firstDay = time.Sunday
+
+// The upper bounds of the roughly log-spaced trip duration buckets of a :Trip
+// edge's durations, in seconds. A last bucket counts trips of a day or more,
+// and the first includes trips with negative durations.
+var durationBounds = []int{
+	60, 2 * 60, 3 * 60, 5 * 60, 7 * 60, 10 * 60, 15 * 60, 20 * 60, 30 * 60, 45 * 60,
+	60 * 60, 90 * 60, 2 * 3600, 3 * 3600, 4 * 3600, 6 * 3600, 12 * 3600, 24 * 3600,
+}
+
+// The months series of a :Trip edge starts in January of firstYear. Citi Bike
+// launched in May 2013.
+const firstYear = 2013
+
+// monthIndex is the element of the months series counting a time, or -1 if it
+// is before the series.
+func monthIndex(t time.Time) int {
+	if t.Year() < firstYear {
+		return -1
+	}
+	return (t.Year()-firstYear)*12 + int(t.Month()) - 1
+}
+
+// yearCounts is the property counting the trips of a year by hour of week.
+func yearCounts(year int) string {
+	return "counts_y" + strconv.Itoa(year)
+}
+
+// durationBucket is the bucket of a trip duration.
+func durationBucket(d time.Duration) int {
+	secs := int(d / time.Second)
+	for i, b := range durationBounds {
+		if secs < b {
+			return i
+		}
+	}
+	return len(durationBounds)
+}
+
+// A BucketConvention describes how trips are bucketed into the counts of the
+// :Trip edges. It is stored in the graph's BUCKETS key, so the backend can
+// report it, and so every file of a graph is bucketed alike.
+type BucketConvention struct {
+	// Buckets of "hour_of_week" are indexed by day*24 + hour, where day 0 is
+	// FirstDay.
+	Buckets  string
+	FirstDay string
+	// The zone of the wall clock hours.
+	TimeZone string
+	// The upper bounds of the durations buckets, in seconds.
+	DurationBounds []int
+	// The month of element 0 of the months series, as "2006-01".
+	FirstMonth string
+	// If YearCounts is true, each year from FirstMonth also has a
+	// counts_y<year> property.
+	YearCounts bool `json:",omitempty"`
+}
+
+func bucketConvention(loc *time.Location, yearCounts bool) BucketConvention {
+	return BucketConvention{
+		Buckets:        "hour_of_week",
+		FirstDay:       firstDay.String(),
+		TimeZone:       loc.String(),
+		DurationBounds: durationBounds,
+		FirstMonth:     fmt.Sprintf("%d-01", firstYear),
+		YearCounts:     yearCounts,
+	}
+}
+
+// The relationship types of edges. :Trip edges count trips, and :Rebalance
+// edges count bikes moved between stations by the operator.
+const (
+	relTrip      = "Trip"
+	relRebalance = "Rebalance"
+)
+
+// An edgeKey identifies the edge of type rel between two stations.
+type edgeKey struct {
+	src, dst string
+	rel      string
+}
+
+// String is the edge's member in the IMPORT_EDGES sets.
+func (k edgeKey) String() string {
+	if k.rel != relTrip {
+		return k.rel + ":" + k.src + "->" + k.dst
+	}
+	return k.src + "->" + k.dst
+}
+
+// A countSpan is the run of a vector property's elements counted by an edge
+// update, starting at element From. The elements outside it are 0. Most edges
+// count few trips in a window, so spans keep their aggregation small.
+type countSpan struct {
+	From   int
+	Counts []int
+	// The length of the property's vector, which may be longer than the span.
+	Size int
+}
+
+// size is the length of the span's vector, including the elements after it.
+func (s *countSpan) size() int {
+	if n := s.From + len(s.Counts); n > s.Size {
+		return n
+	}
+	return s.Size
+}
+
+// dense returns the vector of the span, of length size().
+func (s *countSpan) dense() []int {
+	v := make([]int, s.size())
+	copy(v[s.From:], s.Counts)
+	return v
+}
+
+// edgeCounts are the vector properties of a :Trip edge, keyed by property name.
+// They are added elementwise to the edge's existing properties.
+type edgeCounts map[string]*countSpan
+
+// add increments element idx of the named vector, which has size elements, or
+// more if idx is beyond them.
+func (c edgeCounts) add(prop string, size, idx, n int) {
+	s, ok := c[prop]
+	switch {
+	case !ok:
+		c[prop] = &countSpan{From: idx, Counts: []int{n}, Size: size}
+		return
+	case idx < s.From:
+		s.Counts = append(make([]int, s.From-idx, s.From-idx+len(s.Counts)), s.Counts...)
+		s.From = idx
+	case idx >= s.From+len(s.Counts):
+		s.Counts = append(s.Counts, make([]int, idx+1-s.From-len(s.Counts))...)
+	}
+	if size > s.Size {
+		s.Size = size
+	}
+	s.Counts[idx-s.From] += n
+}
+
+// props returns the property names, sorted so query strings are stable.
+func (c edgeCounts) props() []string {
+	var props []string
+	for p := range c {
+		props = append(props, p)
+	}
+	sort.Strings(props)
+	return props
+}
+
+type station struct {
+	id, name  string
+	lat, long float64
+}
+
+// An edgeUpdate is the aggregated contribution of many Trips to a single edge.
+// The stations are nil if the update only changes an existing edge.
+type edgeUpdate struct {
+	key      edgeKey
+	src, dst *station
+	trips    int
+	counts   edgeCounts
+}
+
+// A tripAggregator accumulates Trips into one edgeUpdate per station pair, so
+// each edge is written once per window rather than once per trip. Rebalancing
+// moves are accumulated into :Rebalance edges in the same way.
+type tripAggregator struct {
+	edges map[edgeKey]*edgeUpdate
+	trips int
+	moves int
+	// If yearCounts is true, trips are also counted in counts_y<year>.
+	yearCounts bool
+}
+
+func newTripAggregator() *tripAggregator {
+	return &tripAggregator{edges: make(map[edgeKey]*edgeUpdate)}
+}
+
+// hourOfWeek is the bucket of a time in its own zone.
+func hourOfWeek(t time.Time) int {
+	day := (int(t.Weekday()) - int(firstDay) + 7) % 7
+	return day*24 + t.Hour()
+}
+
+// The counts property of each rider type, in addition to the total counts.
+var riderTypeCounts = map[RiderType]string{
+	RiderMember: "counts_member",
+	RiderCasual: "counts_casual",
+}
+
+// The counts property of each known rideable type.
+var rideableTypeCounts = map[RideableType]string{
+	RideableClassic:  "counts_classic_bike",
+	RideableElectric: "counts_electric_bike",
+	RideableDocked:   "counts_docked_bike",
+}
+
+func (a *tripAggregator) newEdge(k edgeKey, src, dst *station) *edgeUpdate {
+	e := &edgeUpdate{key: k, src: src, dst: dst, counts: make(edgeCounts)}
+	a.edges[k] = e
+	return e
+}
+
+func (a *tripAggregator) add(t *Trip) {
+	k := edgeKey{t.StartStationId, t.EndStationId, relTrip}
+	e, ok := a.edges[k]
+	if !ok {
+		e = a.newEdge(k,
+			&station{t.StartStationId, t.StartStationName, t.StartStationLat, t.StartStationLong},
+			&station{t.EndStationId, t.EndStationName, t.EndStationLat, t.EndStationLong})
+	}
+	e.trips++
+	hour := hourOfWeek(t.StartTime)
+	e.counts.add("counts", hoursPerWeek, hour, 1)
+	if prop, ok := riderTypeCounts[t.RiderType]; ok {
+		e.counts.add(prop, hoursPerWeek, hour, 1)
+	}
+	if prop, ok := rideableTypeCounts[t.RideableType]; ok {
+		e.counts.add(prop, hoursPerWeek, hour, 1)
+	}
+	if m := monthIndex(t.StartTime); m >= 0 {
+		if a.yearCounts {
+			e.counts.add(yearCounts(t.StartTime.Year()), hoursPerWeek, hour, 1)
+		}
+		e.counts.add("months", m+1, m, 1)
+	}
+	e.counts.add("month_of_year", 12, int(t.StartTime.Month())-1, 1)
+	e.counts.add("durations", len(durationBounds)+1, durationBucket(t.StopTime.Sub(t.StartTime)), 1)
+	a.trips++
+}
+
+// addMove counts a rebalancing move between two stations, in the hour of week
+// the bike reappeared. Moves are not trips.
+func (a *tripAggregator) addMove(from, to *station, at time.Time) {
+	k := edgeKey{from.id, to.id, relRebalance}
+	e, ok := a.edges[k]
+	if !ok {
+		e = a.newEdge(k, from, to)
+	}
+	e.counts.add("counts", hoursPerWeek, hourOfWeek(at), 1)
+	a.moves++
+}
+
+// edgeQuery builds the query which merges an edgeUpdate into the graph, as an
+// edge of type rel. Each vector property p is sent as its span: $p counts the
+// elements from $p_from, of a vector of $p_size elements. The span is added
+// elementwise, treating missing elements as 0. Series such as months grow, so
+// the result is as long as the longer vector.
+func edgeQuery(rel string, props []string) string {
+	var q strings.Builder
+	q.WriteString(`
+		MATCH (src:Station{id: $src})
+		MATCH (dst:Station{id: $dst})
+		MERGE (src)-[t:` + rel + `]->(dst)
+		SET `)
+	for i, p := range props {
+		if i > 0 {
+			q.WriteString(", ")
+		}
+		tp, pp, from, size := "t."+p, "$"+p, "$"+p+"_from", "$"+p+"_size"
+		// Negative list indexes count from the end, so the span's index is
+		// guarded rather than coalesced.
+		q.WriteString(tp + " = [i IN range(0, CASE WHEN size(coalesce(" + tp + ", [])) > " + size + " THEN size(" + tp + ") ELSE " + size + " END - 1)" +
+			" | coalesce(" + tp + "[i], 0) + CASE WHEN i >= " + from + " AND i < " + from + " + size(" + pp + ") THEN " + pp + "[i - " + from + "] ELSE 0 END]")
+	}
+	return q.String()
+}
+
+func intsParam(v []int) []interface{} {
+	p := make([]interface{}, len(v))
+	for i, n := range v {
+		p[i] = n
+	}
+	return p
+}
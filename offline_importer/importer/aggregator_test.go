@@ -0,0 +1,167 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mergeCounts adds an update's span to an edge's vector, as edgeQuery does:
+// the result is as long as the longer of the vector and the span's, and
+// missing elements are 0.
+func mergeCounts(existing []int, update *countSpan) []int {
+	n := len(existing)
+	if update.size() > n {
+		n = update.size()
+	}
+	merged := make([]int, n)
+	copy(merged, existing)
+	for i, c := range update.Counts {
+		merged[update.From+i] += c
+	}
+	return merged
+}
+
+// TestAggregatorCounts checks that the fixture's trips, aggregated in windows
+// and merged into edges, count the same as counting each trip on its own.
+func TestAggregatorCounts(t *testing.T) {
+	for _, byYear := range []bool{false, true} {
+		t.Run(fmt.Sprintf("yearCounts=%v", byYear), func(t *testing.T) {
+			testAggregatorCounts(t, byYear)
+		})
+	}
+}
+
+func testAggregatorCounts(t *testing.T, byYear bool) {
+	const window = 1000
+	r, err := NewTripdataReader(fixtureArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	graph := make(map[edgeKey]map[string][]int)
+	want := make(map[edgeKey]map[string][]int)
+	count := func(k edgeKey, prop string, idx int) {
+		if want[k] == nil {
+			want[k] = make(map[string][]int)
+		}
+		want[k][prop] = mergeCounts(want[k][prop], &countSpan{From: idx, Counts: []int{1}})
+	}
+	flush := func(agg *tripAggregator) {
+		for k, e := range agg.edges {
+			if graph[k] == nil {
+				graph[k] = make(map[string][]int)
+			}
+			for p, s := range e.counts {
+				graph[k][p] = mergeCounts(graph[k][p], s)
+			}
+		}
+	}
+	newAggregator := func() *tripAggregator {
+		agg := newTripAggregator()
+		agg.yearCounts = byYear
+		return agg
+	}
+
+	agg := newAggregator()
+	trips := 0
+	for {
+		trip, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		agg.add(trip)
+		trips++
+		if trips%window == 0 {
+			flush(agg)
+			agg = newAggregator()
+		}
+
+		k := edgeKey{trip.StartStationId, trip.EndStationId, relTrip}
+		hour := hourOfWeek(trip.StartTime)
+		count(k, "counts", hour)
+		if prop, ok := riderTypeCounts[trip.RiderType]; ok {
+			count(k, prop, hour)
+		}
+		if prop, ok := rideableTypeCounts[trip.RideableType]; ok {
+			count(k, prop, hour)
+		}
+		if byYear {
+			count(k, yearCounts(trip.StartTime.Year()), hour)
+		}
+		count(k, "months", (trip.StartTime.Year()-firstYear)*12+int(trip.StartTime.Month())-1)
+		count(k, "month_of_year", int(trip.StartTime.Month())-1)
+		count(k, "durations", durationBucket(trip.StopTime.Sub(trip.StartTime)))
+	}
+	flush(agg)
+
+	if len(graph) != len(want) {
+		t.Fatalf("got %v edges, want %v", len(graph), len(want))
+	}
+	total := 0
+	for k, props := range want {
+		if len(graph[k]) != len(props) {
+			t.Errorf("edge %v: got %v properties, want %v", k, len(graph[k]), len(props))
+		}
+		for p, v := range props {
+			// Fixed-size vectors are written in full; trailing zeros are
+			// otherwise insignificant.
+			got := graph[k][p]
+			if len(got) > len(v) {
+				v = mergeCounts(v, &countSpan{Size: len(got)})
+			}
+			if !reflect.DeepEqual(got, v) {
+				t.Errorf("edge %v %v: got %v, want %v", k, p, got, v)
+			}
+		}
+		for _, n := range graph[k]["counts"] {
+			total += n
+		}
+	}
+	if total != trips {
+		t.Errorf("edges count %v trips, want %v", total, trips)
+	}
+}
+
+func TestCountSpan(t *testing.T) {
+	c := make(edgeCounts)
+	c.add("months", 5, 4, 1)
+	c.add("months", 7, 6, 2)
+	c.add("months", 3, 2, 3)
+	s := c["months"]
+	if s.From != 2 || !reflect.DeepEqual(s.Counts, []int{3, 0, 1, 0, 2}) {
+		t.Errorf("got span from %v of %v, want from 2 of [3 0 1 0 2]", s.From, s.Counts)
+	}
+	if got, want := s.dense(), []int{0, 0, 3, 0, 1, 0, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got dense %v, want %v", got, want)
+	}
+	c.add("counts", hoursPerWeek, 8, 1)
+	if got := len(c["counts"].dense()); got != hoursPerWeek {
+		t.Errorf("got dense counts of %v elements, want %v", got, hoursPerWeek)
+	}
+}
+
+func TestEdgeQuery(t *testing.T) {
+	q := edgeQuery(relTrip, []string{"counts", "months"})
+	for _, want := range []string{
+		"MERGE (src)-[t:Trip]->(dst)",
+		// Grows to the longer of the edge's and the update's vectors.
+		"t.counts = [i IN range(0, CASE WHEN size(coalesce(t.counts, [])) > $counts_size THEN size(t.counts) ELSE $counts_size END - 1)",
+		// Adds the span elementwise, treating missing elements as 0.
+		"| coalesce(t.counts[i], 0) + CASE WHEN i >= $counts_from AND i < $counts_from + size($counts) THEN $counts[i - $counts_from] ELSE 0 END]",
+		", t.months = [i IN range(0, CASE WHEN size(coalesce(t.months, [])) > $months_size",
+	} {
+		if !strings.Contains(q, want) {
+			t.Errorf("query %q does not contain %q", q, want)
+		}
+	}
+	if q := edgeQuery(relRebalance, []string{"counts"}); !strings.Contains(q, "MERGE (src)-[t:Rebalance]->(dst)") {
+		t.Errorf("rebalance query %q does not merge a :Rebalance edge", q)
+	}
+}
@@ -0,0 +1,93 @@
+package importer
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Bikes are tracked across trips to infer rebalancing: when a bike's trip
+// starts at a different station than its previous trip ended, the operator
+// moved it there. The last drop-off of each bike is kept in BIKES, committed
+// with each file's progress, so moves spanning files, or an interrupted
+// import, are still found.
+
+// A dropoff is where and when a bike's latest trip ended.
+type dropoff struct {
+	Station   string
+	Name      string
+	Lat, Long float64
+	Time      time.Time
+	// When the trip started. Zero in drop-offs recorded before it was kept.
+	Start time.Time
+}
+
+// started returns when the trip of the drop-off started, or else when it ended.
+func (d *dropoff) started() time.Time {
+	if d.Start.IsZero() {
+		return d.Time
+	}
+	return d.Start
+}
+
+type bikeTracker struct {
+	last  map[string]*dropoff
+	dirty map[string]bool // Bikes tracked since the last sendDirty.
+}
+
+// loadBikes reads the last drop-off of every bike from key.
+func loadBikes(conn redis.Conn, key string) (*bikeTracker, error) {
+	m, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+	b := &bikeTracker{last: make(map[string]*dropoff, len(m)), dirty: make(map[string]bool)}
+	for bike, v := range m {
+		var d dropoff
+		if err := json.Unmarshal([]byte(v), &d); err != nil {
+			return nil, err
+		}
+		b.last[bike] = &d
+	}
+	return b, nil
+}
+
+// track records a Trip's drop-off, and returns the station its bike was moved
+// from, or nil if it started where it was left. Trips without a bike id, or
+// starting before the bike's previous trip started (e.g. from an archive
+// imported out of order), are ignored. A trip may start shortly before the
+// previous trip ended, as the clocks of docks are often a few seconds apart.
+func (b *bikeTracker) track(t *Trip) *station {
+	if t.BikeId == "" {
+		return nil
+	}
+	last := b.last[t.BikeId]
+	if last != nil && t.StartTime.Before(last.started()) {
+		return nil
+	}
+	b.last[t.BikeId] = &dropoff{t.EndStationId, t.EndStationName, t.EndStationLat, t.EndStationLong, t.StopTime, t.StartTime}
+	b.dirty[t.BikeId] = true
+	if last == nil || last.Station == t.StartStationId {
+		return nil
+	}
+	return &station{last.Station, last.Name, last.Lat, last.Long}
+}
+
+// sendDirty sends an HSET of the bikes tracked since the last call, to be
+// committed with the rows they were read from.
+func (b *bikeTracker) sendDirty(conn redis.Conn, key string) error {
+	if len(b.dirty) == 0 {
+		return nil
+	}
+	args := redis.Args{key}
+	for bike := range b.dirty {
+		v, err := json.Marshal(b.last[bike])
+		if err != nil {
+			return err
+		}
+		args = append(args, bike, v)
+	}
+	b.dirty = make(map[string]bool)
+	return conn.Send("HSET", args...)
+}
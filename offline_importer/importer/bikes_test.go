@@ -0,0 +1,29 @@
+package importer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrackClockSkew(t *testing.T) {
+	b := &bikeTracker{last: make(map[string]*dropoff), dirty: make(map[string]bool)}
+	at := func(s int) time.Time { return time.Date(2015, 1, 1, 10, 0, s, 0, time.UTC) }
+	trips := []struct {
+		trip     Trip
+		wantMove bool
+	}{
+		{Trip{BikeId: "1", StartStationId: "A", EndStationId: "B", StartTime: at(0), StopTime: at(30)}, false},
+		// Starts 3s before the previous trip ended, at the same station.
+		{Trip{BikeId: "1", StartStationId: "B", EndStationId: "C", StartTime: at(27), StopTime: at(50)}, false},
+		{Trip{BikeId: "1", StartStationId: "C", EndStationId: "A", StartTime: at(55), StopTime: at(59)}, false},
+		// Starts before the previous trip started, so is out of order.
+		{Trip{BikeId: "1", StartStationId: "D", EndStationId: "E", StartTime: at(1), StopTime: at(2)}, false},
+		{Trip{BikeId: "1", StartStationId: "B", EndStationId: "A", StartTime: at(59), StopTime: at(59)}, true},
+	}
+	for i, tt := range trips {
+		from := b.track(&tt.trip)
+		if got := from != nil; got != tt.wantMove {
+			t.Errorf("trip %v: got move from %+v, want move %v", i, from, tt.wantMove)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package importer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Each file's contribution to the graph is recorded in the CONTRIB:<file>
+// list, so it can later be subtracted. Every batch pushes a gzipped gob of its
+// edge updates, in the same transaction that writes them.
+
+// A contribEdge is the contribution of one batch to one edge.
+type contribEdge struct {
+	Src, Dst string
+	Rel      string // Empty in contributions recorded before :Rebalance edges.
+	Trips    int
+	Counts   map[string][]int
+}
+
+func encodeContrib(edges []*edgeUpdate, sign int) ([]byte, error) {
+	var contrib []contribEdge
+	for _, e := range edges {
+		counts := make(map[string][]int, len(e.counts))
+		for p, s := range e.counts {
+			v := s.dense()
+			for i := range v {
+				v[i] *= sign
+			}
+			counts[p] = v
+		}
+		contrib = append(contrib, contribEdge{e.key.src, e.key.dst, e.key.rel, sign * e.trips, counts})
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(zw).Encode(contrib); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeContrib(blob []byte) ([]contribEdge, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		return nil, err
+	}
+	var contrib []contribEdge
+	if err := gob.NewDecoder(zr).Decode(&contrib); err != nil {
+		return nil, err
+	}
+	return contrib, nil
+}
+
+// loadContribution sums the contribution recorded in key into an aggregator,
+// with every count multiplied by sign. It returns nil if no contribution was
+// recorded.
+func loadContribution(conn redis.Conn, key string, sign int) (*tripAggregator, error) {
+	blobs, err := redis.ByteSlices(conn.Do("LRANGE", key, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	if len(blobs) == 0 {
+		return nil, nil
+	}
+	agg := newTripAggregator()
+	for _, blob := range blobs {
+		contrib, err := decodeContrib(blob)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range contrib {
+			k := edgeKey{c.Src, c.Dst, c.Rel}
+			if k.rel == "" {
+				k.rel = relTrip
+			}
+			e, ok := agg.edges[k]
+			if !ok {
+				e = &edgeUpdate{key: k, counts: make(edgeCounts)}
+				agg.edges[k] = e
+			}
+			e.trips += sign * c.Trips
+			agg.trips += sign * c.Trips
+			for p, v := range c.Counts {
+				for i, n := range v {
+					e.counts.add(p, len(v), i, sign*n)
+				}
+			}
+		}
+	}
+	return agg, nil
+}
@@ -1,137 +1,424 @@
 package importer
 
 import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"strings"
 	"sync"
-	"time"
 
 	"github.com/gomodule/redigo/redis"
 	rg "github.com/redislabs/redisgraph-go"
 )
 
-// DataWriter writes Trips to the RedisGraph. It is optimised for throughput,
-// using concurrent writers, each writing batches of CREATE commands.
+// DataWriter writes Trips to the RedisGraph. It is optimised for throughput:
+// Trips are aggregated in memory into one update per edge, and these updates
+// are written by concurrent writers, each writing batches of MERGE commands.
+//
+// Imports are checkpointed so an interrupted run never double-counts a file.
+// Each file is aggregated in windows of rows. Every batch is written in a
+// MULTI/EXEC which also adds its edges to IMPORT_EDGES:<file>, and once the
+// window is written its end row is recorded in IMPORT_PROGRESS. A restarted
+// import resumes from that row, skipping edges already written in the window.
+// If RecordContributions is set, each batch also records its edge updates in
+// CONTRIB:<file>, so a file's contribution can later be retracted.
 type DataWriter struct {
 	connPool   *redis.Pool
+	keys       Keys
 	numWorkers int
 	batchSize  int
+	// The number of rows aggregated before flushing. If 0, each file is
+	// aggregated whole.
+	windowSize int
+	// If verify is true, the replies of every batch are read and checked,
+	// rather than discarded with CLIENT REPLY OFF.
+	verify bool
 
-	// Optimisation: cache the station IDs we have already created.
-	stationsCreated sync.Map
+	// RecordContributions records each file's edge updates in CONTRIB:<file>.
+	// The lists are about as large as the graph, so they are only kept if the
+	// files may be retracted or re-imported.
+	RecordContributions bool
+	// YearCounts also counts trips in a counts_y<year> property per year.
+	YearCounts bool
 
-	trips   chan *Trip
-	done    chan bool
-	workers []dataWriterWorker
+	// Optimisation: cache the station IDs we have already created. Stations are
+	// only created by writeStations, never by the workers.
+	stationsCreated map[string]bool
+	// The versions of each station, as of the rows read so far.
+	stations *stationTracker
+
+	// The file being imported, and the end row of its current window.
+	file      string
+	windowEnd int
+	// Edges already written in the current window by a previous run.
+	skipEdges map[string]bool
+	// The last drop-off of each bike, as of the rows read so far.
+	bikes *bikeTracker
+
+	agg     *tripAggregator
+	workers []*dataWriterWorker
+	done    sync.WaitGroup
+
+	mu sync.Mutex
+	// Failed graph queries, by kind, since the last window.
+	failures   map[string]int
+	firstError error
+	// The first error of a worker. Once set, no further trips are written.
+	err error
 }
 
 type dataWriterWorker struct {
 	id   int
 	dw   *DataWriter
 	conn redis.Conn
+	work chan workItem
 
-	pipelineCnt int // The number of commands waiting to be flushed.
-	tripCnt     int // The number of trips written.
+	pipelineCnt int           // The number of graph queries waiting to be flushed.
+	queuedCnt   int           // The number of commands queued in the batch's transaction.
+	tripCnt     int           // The number of trips written.
+	updates     []*edgeUpdate // The edge updates written in this batch, in order.
+	contrib     bool          // Whether to record the batch in CONTRIB:<file>.
 }
 
-func NewDataWriter(pool *redis.Pool, numWorkers, batchSize int) (*DataWriter, error) {
+// A workItem is either an edge to write, or a request to flush the pipeline.
+type workItem struct {
+	file      string
+	windowEnd int
+	edge      *edgeUpdate
+	contrib   bool
+	flushed   *sync.WaitGroup
+}
+
+// NewDataWriter starts a DataWriter with numWorkers workers, each committing
+// batches of up to batchSize graph queries.
+func NewDataWriter(pool *redis.Pool, keys Keys, numWorkers, batchSize, windowSize int, verify bool) (*DataWriter, error) {
+	if numWorkers < 1 {
+		return nil, fmt.Errorf("need at least 1 worker, got %v", numWorkers)
+	}
+	if batchSize < 1 {
+		return nil, fmt.Errorf("batches need at least 1 query, got %v", batchSize)
+	}
 	dw := &DataWriter{
 		connPool:   pool,
+		keys:       keys,
 		numWorkers: numWorkers,
 		batchSize:  batchSize,
-		trips:      make(chan *Trip),
-		done:       make(chan bool),
+		windowSize: windowSize,
+		verify:     verify,
+		agg:        newTripAggregator(),
+		failures:   make(map[string]int),
+
+		stationsCreated: make(map[string]bool),
 	}
 	for i := 1; i <= dw.numWorkers; i++ {
 		dw.addWorker()
+		dw.done.Add(1)
 		go dw.workers[len(dw.workers)-1].Run()
 	}
 	return dw, nil
 }
 
-// Calling Close is important to flush any final batches of Trips.
-func (dw *DataWriter) Close() {
-	close(dw.trips)
-	for i := 1; i <= dw.numWorkers; i++ {
-		<-dw.done
+// Calling Close is important to stop the workers. Trips of an unfinished file
+// which were not checkpointed are discarded, and will be re-read when its
+// import is resumed. The first worker error is returned, if any.
+func (dw *DataWriter) Close() error {
+	for _, w := range dw.workers {
+		close(w.work)
 	}
+	dw.done.Wait()
+	return dw.Err()
 }
 
-// Asynchronously writes a Trip to the graph. Failures will panic.
-func (dw *DataWriter) WriteTrip(t *Trip) {
-	dw.trips <- t
+// Err returns the first error of any worker.
+func (dw *DataWriter) Err() error {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	return dw.err
 }
 
-func (dw *DataWriter) addWorker() {
-	id := len(dw.workers)
-	dw.workers = append(dw.workers, dataWriterWorker{
-		id: id,
-		dw: dw,
-	})
+func (dw *DataWriter) setErr(err error) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.err == nil {
+		dw.err = err
+	}
 }
 
-func (dww *dataWriterWorker) Run() {
-	var err error
-	dww.conn, err = dww.dw.connPool.Dial()
+// StartFile begins importing a file, and unmarks the graph as verified. It
+// returns the number of rows already committed by a previous run, which the
+// caller must skip.
+func (dw *DataWriter) StartFile(file string) (int, error) {
+	conn := dw.connPool.Get()
+	defer conn.Close()
+
+	// Any write invalidates a verification of the graph.
+	if _, err := conn.Do("DEL", dw.keys.Verified()); err != nil {
+		return 0, err
+	}
+	rows, err := redis.Int(conn.Do("HGET", dw.keys.ImportProgress(), file))
+	if err != nil && err != redis.ErrNil {
+		return 0, err
+	}
+	edges, err := redis.Strings(conn.Do("SMEMBERS", dw.keys.ImportEdges(file)))
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	//dww.conn = redis.NewLoggingConn(dww.conn, log.Default(), fmt.Sprintf("[dww.%v.redis]", dww.id))
-	log.Printf("[dww.%v]: Started", dww.id)
+	// Bikes and stations are tracked from the committed rows, discarding any
+	// tracked since.
+	if dw.bikes, err = loadBikes(conn, dw.keys.Bikes()); err != nil {
+		return 0, err
+	}
+	if dw.stations, err = loadStations(conn, dw.keys.StationHistory()); err != nil {
+		return 0, err
+	}
+	dw.file = file
+	dw.agg = dw.newAggregator()
+	dw.skipEdges = make(map[string]bool)
+	dw.windowEnd = 0
+	if dw.windowSize > 0 {
+		dw.windowEnd = rows + dw.windowSize
+	}
+	if len(edges) > 0 {
+		// Finish the interrupted window with its original end, even if the
+		// window size has since changed.
+		if dw.windowEnd, err = redis.Int(conn.Do("HGET", dw.keys.ImportWindow(), file)); err != nil {
+			return 0, err
+		}
+		for _, e := range edges {
+			dw.skipEdges[e] = true
+		}
+	}
+	if rows > 0 || len(edges) > 0 {
+		log.Printf("[dw]: Resuming %v from row %v, skipping %v written edges", file, rows, len(edges))
+	}
+	return rows, nil
+}
+
+func (dw *DataWriter) newAggregator() *tripAggregator {
+	agg := newTripAggregator()
+	agg.yearCounts = dw.YearCounts
+	return agg
+}
 
-	if err := dww.conn.Send("CLIENT", "REPLY", "OFF"); err != nil {
-		panic(err)
+// Aggregates a Trip read from the given row of the current file. It is
+// asynchronously written to the graph when its window is flushed. Errors of
+// the workers, and failed graph queries when verifying, are returned.
+func (dw *DataWriter) WriteTrip(t *Trip, row int) error {
+	if err := dw.Err(); err != nil {
+		return err
 	}
+	for dw.windowEnd > 0 && row >= dw.windowEnd {
+		if err := dw.flushWindow(); err != nil {
+			return err
+		}
+		if dw.windowSize > 0 {
+			dw.windowEnd += dw.windowSize
+		} else {
+			dw.windowEnd = 0
+		}
+	}
+	dw.stations.seeTrip(t)
+	if from := dw.bikes.track(t); from != nil {
+		dw.agg.addMove(from, &station{t.StartStationId, t.StartStationName, t.StartStationLat, t.StartStationLong}, t.StartTime)
+	}
+	dw.agg.add(t)
+	return nil
+}
 
-	// Main consumer loop
-	for t := range dww.dw.trips {
-		if err := dww.writeTrip(t); err != nil {
-			panic(err)
+// FinishFile flushes the last window of the current file, and atomically
+// marks the file as scraped along with its report.
+func (dw *DataWriter) FinishFile(report *FileReport) error {
+	if err := dw.writeWindow(); err != nil {
+		return err
+	}
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	conn := dw.connPool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("SADD", dw.keys.ScrapedFiles(), dw.file)
+	conn.Send("SREM", dw.keys.Retracted(), dw.file)
+	conn.Send("HSET", dw.keys.FileReports(), dw.file, reportJSON)
+	if err := dw.bikes.sendDirty(conn, dw.keys.Bikes()); err != nil {
+		return err
+	}
+	if err := dw.stations.sendDirty(conn, dw.keys.StationHistory()); err != nil {
+		return err
+	}
+	conn.Send("HDEL", dw.keys.ImportProgress(), dw.file)
+	conn.Send("HDEL", dw.keys.ImportWindow(), dw.file)
+	conn.Send("DEL", dw.keys.ImportEdges(dw.file))
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+const retractPrefix = "RETRACT:"
+
+// RetractFile subtracts the recorded contribution of a file from the graph and
+// the trips counter, and forgets the file. The file is added to RETRACTED,
+// which imports skip, until it is imported again under the same name. Like an
+// import, an interrupted retraction resumes where it stopped. Retracting a
+// file which was never scraped only adds it to RETRACTED.
+func (dw *DataWriter) RetractFile(file string) error {
+	conn := dw.connPool.Get()
+	defer conn.Close()
+	agg, err := loadContribution(conn, dw.keys.Contrib(file), -1)
+	if err != nil {
+		return err
+	}
+	if agg == nil {
+		scraped, err := redis.Bool(conn.Do("SISMEMBER", dw.keys.ScrapedFiles(), file))
+		if err != nil {
+			return err
 		}
+		if scraped {
+			return fmt.Errorf("no contribution recorded for %v, it was imported without recording contributions", file)
+		}
+		agg = newTripAggregator()
+	}
+	if _, err := conn.Do("SADD", dw.keys.Retracted(), file); err != nil {
+		return err
+	}
+	retraction := retractPrefix + file
+	if _, err := dw.StartFile(retraction); err != nil {
+		return err
+	}
+	dw.agg = agg
+	if err := dw.writeEdges(false); err != nil {
+		return err
+	}
+	// Also forget the progress of a partial import, so the file can be
+	// imported again from scratch.
+	conn.Send("MULTI")
+	conn.Send("SREM", dw.keys.ScrapedFiles(), file)
+	conn.Send("HDEL", dw.keys.FileReports(), file)
+	conn.Send("DEL", dw.keys.Contrib(file))
+	conn.Send("HDEL", dw.keys.ImportProgress(), file, retraction)
+	conn.Send("HDEL", dw.keys.ImportWindow(), file, retraction)
+	conn.Send("DEL", dw.keys.ImportEdges(file), dw.keys.ImportEdges(retraction))
+	if _, err := conn.Do("EXEC"); err != nil {
+		return err
 	}
+	log.Printf("[dw]: Retracted %v trips of %v", -agg.trips, file)
+	return nil
+}
 
-	// Final flush
-	if err := dww.flushPipeline(); err != nil {
-		panic(err)
+// flushWindow writes the current window, and commits the row it ended at.
+func (dw *DataWriter) flushWindow() error {
+	if err := dw.writeWindow(); err != nil {
+		return err
 	}
+	return dw.commitProgress(dw.windowEnd)
+}
 
-	if err := dww.conn.Close(); err != nil {
-		panic(err)
+// Checkpoint writes the trips aggregated so far, and commits rows as the
+// progress of the current file, so an interrupted import can stop without
+// losing work. Windows of the current file restart from rows.
+func (dw *DataWriter) Checkpoint(rows int) error {
+	if err := dw.writeWindow(); err != nil {
+		return err
 	}
-	dww.dw.done <- true
-	log.Printf("[dww.%v]: Done", dww.id)
+	if err := dw.commitProgress(rows); err != nil {
+		return err
+	}
+	log.Printf("[dw]: Checkpointed %v at row %v", dw.file, rows)
+	if dw.windowSize > 0 {
+		dw.windowEnd = rows + dw.windowSize
+	}
+	return nil
 }
 
-func (dww *dataWriterWorker) writeTrip(t *Trip) error {
-	dww.tripCnt++
-	err := dww.maybeCreateStation(t.StartStationId, t.StartStationName, t.StartStationLat, t.StartStationLong)
-	if err != nil {
+func (dw *DataWriter) commitProgress(rows int) error {
+	conn := dw.connPool.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("HSET", dw.keys.ImportProgress(), dw.file, rows)
+	if err := dw.bikes.sendDirty(conn, dw.keys.Bikes()); err != nil {
 		return err
 	}
-	err = dww.maybeCreateStation(t.EndStationId, t.EndStationName, t.EndStationLat, t.EndStationLong)
-	if err != nil {
+	if err := dw.stations.sendDirty(conn, dw.keys.StationHistory()); err != nil {
 		return err
 	}
-	return dww.addTripEdge(t.StartStationId, t.EndStationId, t.StartTime)
+	conn.Send("HDEL", dw.keys.ImportWindow(), dw.file)
+	conn.Send("DEL", dw.keys.ImportEdges(dw.file))
+	_, err := conn.Do("EXEC")
+	return err
 }
 
-func (dww *dataWriterWorker) addTripEdge(startStationId, endStationId int, t time.Time) error {
-	hour := int(t.Weekday())*24 + t.Hour()
-	q := `
-		MATCH (src:Station{id: $src})
-		MATCH (dst:Station{id: $dst})
-		MERGE (src)-[t:Trip]->(dst)
-		ON CREATE SET t.counts = [n in range(0, 167) | CASE WHEN n = $hour THEN 1 ELSE 0 END] 
-		ON MATCH SET t.counts = t.counts[0..$hour] + [t.counts[$hour]+1] + t.counts[($hour+1)..168]
-	`
-	return dww.SendGraphQuery(q, map[string]interface{}{
-		"src": startStationId, "dst": endStationId, "hour": hour,
-	})
+// writeWindow writes one update per edge for all the aggregated Trips, and
+// blocks until every worker has flushed its pipeline. If verifying, an error
+// summarising any failed graph queries is returned.
+func (dw *DataWriter) writeWindow() error {
+	return dw.writeEdges(dw.RecordContributions)
+}
+
+// writeEdges writes the aggregated edge updates, recording them in
+// CONTRIB:<file> if contrib is true.
+func (dw *DataWriter) writeEdges(contrib bool) error {
+	agg := dw.agg
+	dw.agg = dw.newAggregator()
+	if err := dw.writeStations(agg); err != nil {
+		return err
+	}
+	skipped := 0
+	for _, e := range agg.edges {
+		if dw.skipEdges[e.key.String()] {
+			skipped++
+			continue
+		}
+		// Shard by edge, so each edge is only ever written by one worker.
+		h := fnv.New32a()
+		h.Write([]byte(e.key.String()))
+		dw.workers[int(h.Sum32()%uint32(len(dw.workers)))].work <- workItem{
+			file: dw.file, windowEnd: dw.windowEnd, edge: e, contrib: contrib,
+		}
+	}
+	log.Printf("[dw]: Wrote %v trips and %v rebalancing moves as %v edge updates (%v already written)", agg.trips, agg.moves, len(agg.edges)-skipped, skipped)
+	dw.skipEdges = make(map[string]bool)
+
+	var flushed sync.WaitGroup
+	flushed.Add(len(dw.workers))
+	for _, w := range dw.workers {
+		w.work <- workItem{flushed: &flushed}
+	}
+	flushed.Wait()
+	if err := dw.Err(); err != nil {
+		return err
+	}
+	return dw.takeFailures()
 }
 
-func (dww *dataWriterWorker) maybeCreateStation(id int, name string, lat, long float64) error {
-	if _, ok := dww.dw.stationsCreated.Load(id); ok {
+// writeStations creates the stations of the aggregated edges which were not
+// created yet, and renames or relocates the stations whose current version
+// changed. It runs before the edges are written, so the workers only MERGE
+// edges between existing stations, and never race to create a station.
+func (dw *DataWriter) writeStations(agg *tripAggregator) error {
+	var stations []*station
+	for _, e := range agg.edges {
+		for _, s := range []*station{e.src, e.dst} {
+			if s == nil || dw.stationsCreated[s.id] {
+				continue
+			}
+			dw.stationsCreated[s.id] = true
+			if cur := dw.stations.current(s.id); cur != nil {
+				s = cur
+			}
+			stations = append(stations, s)
+		}
+	}
+	// Changed stations include those first seen, which may have been created
+	// before the station history was kept.
+	changed := dw.stations.takeChanged()
+	if len(stations) == 0 && len(changed) == 0 {
 		return nil
 	}
+	conn := dw.connPool.Get()
+	defer conn.Close()
+	created := len(stations)
+	stations = append(stations, changed...)
 	q := `
 		OPTIONAL MATCH (s:Station{id: $id})
 		WITH COUNT(s) AS c WHERE c = 0
@@ -141,55 +428,319 @@ func (dww *dataWriterWorker) maybeCreateStation(id int, name string, lat, long f
 			loc: point({latitude: $lat, longitude: $long})
 		})
 	`
-	err := dww.SendGraphQuery(q, map[string]interface{}{
-		"id": id, "name": name, "lat": lat, "long": long,
-	})
-	if err == nil {
-		dww.dw.stationsCreated.Store(id, true)
+	update := `
+		MATCH (s:Station{id: $id})
+		SET s.name = $name, s.loc = point({latitude: $lat, longitude: $long})
+	`
+	for start := 0; start < len(stations); start += dw.batchSize {
+		end := start + dw.batchSize
+		if end > len(stations) {
+			end = len(stations)
+		}
+		batch := stations[start:end]
+		for i, s := range batch {
+			params := map[string]interface{}{"id": s.id, "name": s.name, "lat": s.lat, "long": s.long}
+			query := q
+			if start+i >= created {
+				query = update
+			}
+			if err := conn.Send("GRAPH.QUERY", dw.keys.Graph, rg.BuildParamsHeader(params)+query, "--compact"); err != nil {
+				return err
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		for _, s := range batch {
+			if _, err := conn.Receive(); err != nil {
+				// Forget the stations which may not have been created, so a
+				// resumed import creates them.
+				for _, s := range stations[start:] {
+					delete(dw.stationsCreated, s.id)
+				}
+				return fmt.Errorf("writing station %v: %w", s.id, err)
+			}
+		}
 	}
+	log.Printf("[dw]: Created %v stations, updated %v", created, len(changed))
+	return nil
+}
+
+func (dw *DataWriter) addFailure(kind string, err error) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	dw.failures[kind]++
+	if dw.firstError == nil {
+		dw.firstError = err
+	}
+}
+
+// takeFailures returns an error summarising the failed graph queries, if any,
+// and resets them.
+func (dw *DataWriter) takeFailures() error {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.firstError == nil {
+		return nil
+	}
+	err := fmt.Errorf("failed graph queries %v, first error: %w", dw.failures, dw.firstError)
+	dw.failures = make(map[string]int)
+	dw.firstError = nil
 	return err
 }
 
-func (dww *dataWriterWorker) SendGraphQuery(q string, params map[string]interface{}) error {
-	return dww.Send("GRAPH.QUERY", "journeys", rg.BuildParamsHeader(params)+q, "--compact")
+func (dw *DataWriter) addWorker() {
+	id := len(dw.workers)
+	dw.workers = append(dw.workers, &dataWriterWorker{
+		id:   id,
+		dw:   dw,
+		work: make(chan workItem),
+	})
 }
 
-func (dww *dataWriterWorker) Send(commandName string, args ...interface{}) error {
-	err := dww.conn.Send(commandName, args...)
+func (dww *dataWriterWorker) Run() {
+	defer dww.dw.done.Done()
+	if err := dww.run(); err != nil {
+		log.Printf("[dww.%v]: Failed: %v", dww.id, err)
+		dww.dw.setErr(fmt.Errorf("worker %v: %w", dww.id, err))
+		// Keep consuming work, so the DataWriter never blocks on this worker.
+		for w := range dww.work {
+			if w.flushed != nil {
+				w.flushed.Done()
+			}
+		}
+		return
+	}
+	log.Printf("[dww.%v]: Done", dww.id)
+}
+
+func (dww *dataWriterWorker) run() error {
+	var err error
+	dww.conn, err = dww.dw.connPool.Dial()
 	if err != nil {
 		return err
 	}
-	dww.pipelineCnt++
-	if dww.pipelineCnt >= dww.dw.batchSize {
-		if err = dww.flushPipeline(); err != nil {
+	defer dww.conn.Close()
+	//dww.conn = redis.NewLoggingConn(dww.conn, log.Default(), fmt.Sprintf("[dww.%v.redis]", dww.id))
+	log.Printf("[dww.%v]: Started", dww.id)
+
+	if !dww.dw.verify {
+		if err := dww.conn.Send("CLIENT", "REPLY", "OFF"); err != nil {
+			return err
+		}
+	}
+
+	// Main consumer loop
+	var file string
+	for w := range dww.work {
+		if w.flushed != nil {
+			err := dww.flushPipeline(file)
+			w.flushed.Done()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		file = w.file
+		if err := dww.writeEdge(w); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (dww *dataWriterWorker) flushPipeline() error {
-	log.Printf("[dww.%v]: Flushing %v commands, %v trips", dww.id, dww.pipelineCnt, dww.tripCnt)
-	if err := dww.conn.Send("INCRBY", "trips", dww.tripCnt); err != nil {
+func (dww *dataWriterWorker) writeEdge(w workItem) error {
+	if dww.pipelineCnt == 0 {
+		// Start the batch's transaction, recording the end of the window in case
+		// it is interrupted.
+		if err := dww.conn.Send("MULTI"); err != nil {
+			return err
+		}
+		if err := dww.sendQueued("HSET", dww.dw.keys.ImportWindow(), w.file, w.windowEnd); err != nil {
+			return err
+		}
+	}
+	e := w.edge
+	dww.tripCnt += e.trips
+	dww.updates = append(dww.updates, e)
+	dww.contrib = w.contrib
+	if err := dww.addTripEdge(e); err != nil {
+		return err
+	}
+	if dww.pipelineCnt >= dww.dw.batchSize {
+		return dww.flushPipeline(w.file)
+	}
+	return nil
+}
+
+func (dww *dataWriterWorker) addTripEdge(e *edgeUpdate) error {
+	props := e.counts.props()
+	params := map[string]interface{}{"src": e.key.src, "dst": e.key.dst}
+	for _, p := range props {
+		s := e.counts[p]
+		params[p] = intsParam(s.Counts)
+		params[p+"_from"] = s.From
+		params[p+"_size"] = s.size()
+	}
+	return dww.SendGraphQuery(edgeQuery(e.key.rel, props), params)
+}
+
+func (dww *dataWriterWorker) SendGraphQuery(q string, params map[string]interface{}) error {
+	return dww.Send("GRAPH.QUERY", dww.dw.keys.Graph, rg.BuildParamsHeader(params)+q, "--compact")
+}
+
+func (dww *dataWriterWorker) Send(commandName string, args ...interface{}) error {
+	if err := dww.sendQueued(commandName, args...); err != nil {
 		return err
 	}
-	// We toggle CLIENT REPLY ON then OFF so the server can signal the pipeline batch
-	// has been consumed.
-	if err := dww.conn.Send("CLIENT", "REPLY", "ON"); err != nil {
+	dww.pipelineCnt++
+	return nil
+}
+
+// sendQueued sends a command inside the batch's transaction.
+func (dww *dataWriterWorker) sendQueued(commandName string, args ...interface{}) error {
+	if err := dww.conn.Send(commandName, args...); err != nil {
 		return err
 	}
-	if err := dww.conn.Send("CLIENT", "REPLY", "OFF"); err != nil {
+	dww.queuedCnt++
+	return nil
+}
+
+// flushPipeline commits the batch's transaction, along with the trips counter
+// and the batch's edges in IMPORT_EDGES.
+func (dww *dataWriterWorker) flushPipeline(file string) error {
+	if dww.pipelineCnt == 0 {
+		return nil
+	}
+	log.Printf("[dww.%v]: Flushing %v commands, %v trips", dww.id, dww.pipelineCnt, dww.tripCnt)
+	if err := dww.sendQueued("INCRBY", dww.dw.keys.Trips(), dww.tripCnt); err != nil {
 		return err
 	}
-	if err := dww.conn.Flush(); err != nil {
+	var edges []string
+	for _, e := range dww.updates {
+		edges = append(edges, e.key.String())
+	}
+	if err := dww.sendQueued("SADD", redis.Args{dww.dw.keys.ImportEdges(file)}.AddFlat(edges)...); err != nil {
 		return err
 	}
-	// Block until the CLIENY TRPLU ON -> OK response is consumed.
-	if _, err := dww.conn.Receive(); err != nil {
+	if dww.contrib {
+		blob, err := encodeContrib(dww.updates, 1)
+		if err != nil {
+			return err
+		}
+		if err := dww.sendQueued("RPUSH", dww.dw.keys.Contrib(file), blob); err != nil {
+			return err
+		}
+	}
+	if err := dww.conn.Send("EXEC"); err != nil {
 		return err
 	}
+	if dww.dw.verify {
+		if err := dww.conn.Flush(); err != nil {
+			return err
+		}
+		if err := dww.verifyBatch(file); err != nil {
+			return err
+		}
+	} else {
+		// We toggle CLIENT REPLY ON then OFF so the server can signal the pipeline batch
+		// has been consumed.
+		if err := dww.conn.Send("CLIENT", "REPLY", "ON"); err != nil {
+			return err
+		}
+		if err := dww.conn.Send("CLIENT", "REPLY", "OFF"); err != nil {
+			return err
+		}
+		if err := dww.conn.Flush(); err != nil {
+			return err
+		}
+		// Block until the CLIENY TRPLU ON -> OK response is consumed.
+		if _, err := dww.conn.Receive(); err != nil {
+			return err
+		}
+	}
 
 	dww.pipelineCnt = 0
+	dww.queuedCnt = 0
 	dww.tripCnt = 0
+	dww.updates = dww.updates[:0]
 	return nil
 }
+
+// verifyBatch reads the replies of a flushed batch, and records any failed
+// graph queries. The trips of failed edges are subtracted from the trips
+// counter and CONTRIB:<file>, and the edges removed from IMPORT_EDGES, so a
+// resumed import retries them.
+//
+// The graph queries and the batch's bookkeeping must commit together, so the
+// failures are only known after both, and are undone in a second transaction.
+// If the importer dies between the two, the trips counter keeps the failed
+// trips, and a resumed import skips the failed edges. Importer.Verify finds
+// this, as the counter then exceeds the trips counted by the edges.
+func (dww *dataWriterWorker) verifyBatch(file string) error {
+	// MULTI, then +QUEUED for each command.
+	for i := 0; i <= dww.queuedCnt; i++ {
+		if _, err := dww.conn.Receive(); err != nil {
+			return err
+		}
+	}
+	replies, err := redis.Values(dww.conn.Receive())
+	if err != nil {
+		return err
+	}
+	// Skip the reply of HSET IMPORT_WINDOW.
+	replies = replies[1:]
+
+	failedTrips := 0
+	var failedEdges []string
+	var failedUpdates []*edgeUpdate
+	for i, e := range dww.updates {
+		err := queryError(e, replies[i])
+		if err == nil {
+			continue
+		}
+		dww.dw.addFailure("edge", err)
+		failedTrips += e.trips
+		failedEdges = append(failedEdges, e.key.String())
+		failedUpdates = append(failedUpdates, e)
+	}
+	if len(failedEdges) == 0 {
+		return nil
+	}
+	log.Printf("[dww.%v]: %v of %v edge updates failed", dww.id, len(failedEdges), len(dww.updates))
+	dww.conn.Send("MULTI")
+	dww.conn.Send("DECRBY", dww.dw.keys.Trips(), failedTrips)
+	dww.conn.Send("SREM", redis.Args{dww.dw.keys.ImportEdges(file)}.AddFlat(failedEdges)...)
+	if dww.contrib {
+		blob, err := encodeContrib(failedUpdates, -1)
+		if err != nil {
+			return err
+		}
+		dww.conn.Send("RPUSH", dww.dw.keys.Contrib(file), blob)
+	}
+	_, err = dww.conn.Do("EXEC")
+	return err
+}
+
+// queryError checks the reply of an edge update. An edge update which set no
+// properties failed to match its stations.
+func queryError(e *edgeUpdate, reply interface{}) error {
+	if err, ok := reply.(redis.Error); ok {
+		return err
+	}
+	values, err := redis.Values(reply, nil)
+	if err != nil || len(values) == 0 {
+		return fmt.Errorf("unexpected reply for edge %v: %v", e.key, reply)
+	}
+	// The query statistics are the last element of the reply.
+	stats, err := redis.Strings(values[len(values)-1], nil)
+	if err != nil {
+		return fmt.Errorf("unexpected reply for edge %v: %v", e.key, reply)
+	}
+	for _, s := range stats {
+		if strings.HasPrefix(s, "Properties set:") {
+			return nil
+		}
+	}
+	return fmt.Errorf("edge %v matched no stations", e.key)
+}
@@ -0,0 +1,332 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// fakeRedis is an in-memory Redis with the commands the importer uses. Graph
+// queries are acknowledged as if they set a property, but not evaluated, so
+// tests check the importer's bookkeeping rather than the graph.
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string]string
+	sets    map[string]map[string]bool
+	hashes  map[string]map[string]string
+	lists   map[string][]string
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		strings: make(map[string]string),
+		sets:    make(map[string]map[string]bool),
+		hashes:  make(map[string]map[string]string),
+		lists:   make(map[string][]string),
+	}
+}
+
+func (r *fakeRedis) pool() *redis.Pool {
+	return &redis.Pool{Dial: func() (redis.Conn, error) { return &fakeConn{r: r}, nil }}
+}
+
+func (r *fakeRedis) exists(key string) bool {
+	_, s := r.strings[key]
+	_, set := r.sets[key]
+	_, h := r.hashes[key]
+	_, l := r.lists[key]
+	return s || set || h || l
+}
+
+func (r *fakeRedis) keys() []string {
+	var keys []string
+	for k := range r.strings {
+		keys = append(keys, k)
+	}
+	for k := range r.sets {
+		keys = append(keys, k)
+	}
+	for k := range r.hashes {
+		keys = append(keys, k)
+	}
+	for k := range r.lists {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *fakeRedis) del(key string) bool {
+	ok := r.exists(key)
+	delete(r.strings, key)
+	delete(r.sets, key)
+	delete(r.hashes, key)
+	delete(r.lists, key)
+	return ok
+}
+
+func bulks(values []string) []interface{} {
+	replies := make([]interface{}, len(values))
+	for i, v := range values {
+		replies[i] = []byte(v)
+	}
+	return replies
+}
+
+// do runs a command, with the lock held.
+func (r *fakeRedis) do(cmd string, args []string) interface{} {
+	switch cmd {
+	case "PING":
+		return "PONG"
+	case "GET":
+		if v, ok := r.strings[args[0]]; ok {
+			return []byte(v)
+		}
+		return nil
+	case "SET":
+		r.strings[args[0]] = args[1]
+		return "OK"
+	case "SETNX":
+		if r.exists(args[0]) {
+			return int64(0)
+		}
+		r.strings[args[0]] = args[1]
+		return int64(1)
+	case "EXISTS":
+		n := int64(0)
+		for _, k := range args {
+			if r.exists(k) {
+				n++
+			}
+		}
+		return n
+	case "INCR", "INCRBY", "DECRBY":
+		by := int64(1)
+		if len(args) > 1 {
+			var err error
+			if by, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				return redis.Error("ERR value is not an integer")
+			}
+		}
+		if cmd == "DECRBY" {
+			by = -by
+		}
+		n, _ := strconv.ParseInt(r.strings[args[0]], 10, 64)
+		n += by
+		r.strings[args[0]] = strconv.FormatInt(n, 10)
+		return n
+	case "DEL":
+		n := int64(0)
+		for _, k := range args {
+			if r.del(k) {
+				n++
+			}
+		}
+		return n
+	case "KEYS":
+		var keys []string
+		for _, k := range r.keys() {
+			if ok, _ := path.Match(args[0], k); ok {
+				keys = append(keys, k)
+			}
+		}
+		return bulks(keys)
+	case "SADD":
+		set := r.sets[args[0]]
+		if set == nil {
+			set = make(map[string]bool)
+			r.sets[args[0]] = set
+		}
+		n := int64(0)
+		for _, m := range args[1:] {
+			if !set[m] {
+				set[m] = true
+				n++
+			}
+		}
+		return n
+	case "SREM":
+		set := r.sets[args[0]]
+		n := int64(0)
+		for _, m := range args[1:] {
+			if set[m] {
+				delete(set, m)
+				n++
+			}
+		}
+		if len(set) == 0 {
+			delete(r.sets, args[0])
+		}
+		return n
+	case "SISMEMBER":
+		if r.sets[args[0]][args[1]] {
+			return int64(1)
+		}
+		return int64(0)
+	case "SCARD":
+		return int64(len(r.sets[args[0]]))
+	case "SMEMBERS":
+		var members []string
+		for m := range r.sets[args[0]] {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		return bulks(members)
+	case "HGET":
+		if v, ok := r.hashes[args[0]][args[1]]; ok {
+			return []byte(v)
+		}
+		return nil
+	case "HSET":
+		h := r.hashes[args[0]]
+		if h == nil {
+			h = make(map[string]string)
+			r.hashes[args[0]] = h
+		}
+		n := int64(0)
+		for i := 1; i+1 < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				n++
+			}
+			h[args[i]] = args[i+1]
+		}
+		return n
+	case "HDEL":
+		h := r.hashes[args[0]]
+		n := int64(0)
+		for _, f := range args[1:] {
+			if _, ok := h[f]; ok {
+				delete(h, f)
+				n++
+			}
+		}
+		if len(h) == 0 {
+			delete(r.hashes, args[0])
+		}
+		return n
+	case "HLEN":
+		return int64(len(r.hashes[args[0]]))
+	case "HGETALL", "HVALS":
+		h := r.hashes[args[0]]
+		var fields []string
+		for f := range h {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		var values []string
+		for _, f := range fields {
+			if cmd == "HGETALL" {
+				values = append(values, f)
+			}
+			values = append(values, h[f])
+		}
+		return bulks(values)
+	case "RPUSH":
+		r.lists[args[0]] = append(r.lists[args[0]], args[1:]...)
+		return int64(len(r.lists[args[0]]))
+	case "LRANGE":
+		// Only whole lists are read.
+		return bulks(r.lists[args[0]])
+	case "GRAPH.QUERY":
+		return []interface{}{[]interface{}{[]byte("Properties set: 1")}}
+	}
+	return redis.Error(fmt.Sprintf("ERR unknown command '%v'", cmd))
+}
+
+// fakeConn is a connection to a fakeRedis. Commands run when sent, and their
+// replies are queued until received.
+type fakeConn struct {
+	r        *fakeRedis
+	pending  []interface{}
+	multi    bool
+	queued   [][]string
+	replyOff bool
+}
+
+func (c *fakeConn) Close() error { return nil }
+func (c *fakeConn) Err() error   { return nil }
+func (c *fakeConn) Flush() error { return nil }
+
+func (c *fakeConn) Send(cmd string, args ...interface{}) error {
+	if cmd == "" {
+		return nil
+	}
+	sargs := make([]string, len(args))
+	for i, a := range args {
+		switch a := a.(type) {
+		case []byte:
+			sargs[i] = string(a)
+		default:
+			sargs[i] = fmt.Sprint(a)
+		}
+	}
+	var reply interface{}
+	switch {
+	case cmd == "CLIENT" && sargs[0] == "REPLY":
+		c.replyOff = sargs[1] == "OFF"
+		if c.replyOff {
+			return nil
+		}
+		reply = "OK"
+	case cmd == "MULTI":
+		c.multi = true
+		reply = "OK"
+	case cmd == "EXEC":
+		c.r.mu.Lock()
+		replies := make([]interface{}, len(c.queued))
+		for i, q := range c.queued {
+			replies[i] = c.r.do(q[0], q[1:])
+		}
+		c.r.mu.Unlock()
+		c.multi = false
+		c.queued = nil
+		reply = replies
+	case c.multi:
+		c.queued = append(c.queued, append([]string{cmd}, sargs...))
+		reply = "QUEUED"
+	default:
+		c.r.mu.Lock()
+		reply = c.r.do(cmd, sargs)
+		c.r.mu.Unlock()
+	}
+	if !c.replyOff {
+		c.pending = append(c.pending, reply)
+	}
+	return nil
+}
+
+func (c *fakeConn) Receive() (interface{}, error) {
+	if len(c.pending) == 0 {
+		return nil, errors.New("fake redis: no reply pending")
+	}
+	reply := c.pending[0]
+	c.pending = c.pending[1:]
+	if err, ok := reply.(redis.Error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.Send(cmd, args...); err != nil {
+		return nil, err
+	}
+	// Like redigo, return the last reply, or the first error.
+	var reply interface{}
+	var err error
+	for len(c.pending) > 0 {
+		var rerr error
+		if reply, rerr = c.Receive(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	if cmd == "" {
+		return nil, err
+	}
+	return reply, err
+}
@@ -1,47 +1,140 @@
 package importer
 
 import (
-	"encoding/xml"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
-	"strings"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 	rg "github.com/redislabs/redisgraph-go"
 )
 
-const citiBikeBucket = "https://s3.amazonaws.com/tripdata/"
-
-// Importer reads trip data from the Citi Bike System Data bucket, and writes
-// Trips to the RedisGraph. It is optimised for throughput.
+// Importer reads trip data archives from a Source, and writes Trips to the
+// RedisGraph. It is optimised for throughput.
 type Importer struct {
 	connPool *redis.Pool
+	src      Source
+	keys     Keys
 	dw       *DataWriter
+
+	// QuarantineDir, if set, receives a CSV of the rejected rows of each file.
+	QuarantineDir string
+	// Location is the zone of trip times without an offset, and of the
+	// hour-of-week buckets. If nil, it is DefaultTimeZone.
+	Location *time.Location
+	// Mapping, if set, maps the archives' CSV columns onto Trips. If nil, it is
+	// the Citi Bike mapping.
+	Mapping *Mapping
+	// Rules, if set, are the data-quality rules applied to every Trip.
+	Rules *Rules
+	// Decoders is the number of goroutines decoding each archive's CSV rows.
+	// If 0 or 1, rows are decoded on the importing goroutine.
+	Decoders int
+	// If ReimportChanged is true, scraped archives whose size, modification
+	// time or ETag changed are retracted and imported again.
+	ReimportChanged bool
+	// If RecordContributions is true, each archive's edge updates are recorded,
+	// so it can later be retracted, replaced or re-imported when changed.
+	RecordContributions bool
+	// If YearCounts is true, edges also count trips by hour of week per year,
+	// for the backend's year ranges. It is recorded in BUCKETS, so every file
+	// of a graph must be imported alike.
+	YearCounts bool
 }
 
-func NewImporter(connPool *redis.Pool, numWorkers, batchSize int) (*Importer, error) {
-	dw, err := NewDataWriter(connPool, numWorkers, batchSize)
+// NewImporter creates an Importer writing to the named graph.
+func NewImporter(connPool *redis.Pool, src Source, graph string, numWorkers, batchSize, windowSize int, verify bool) (*Importer, error) {
+	keys := Keys{Graph: graph}
+	dw, err := NewDataWriter(connPool, keys, numWorkers, batchSize, windowSize, verify)
 	if err != nil {
 		return nil, err
 	}
-	return &Importer{connPool: connPool, dw: dw}, nil
+	return &Importer{connPool: connPool, src: src, keys: keys, dw: dw}, nil
 }
 
 // Runs the long-running parallel importer. If resetGraph is true, the graph is deleted
-// before starting.
-func (i *Importer) Run(resetGraph bool) error {
+// before starting. When ctx is cancelled, the trips read so far are written and
+// checkpointed, and ctx.Err() is returned.
+func (i *Importer) Run(ctx context.Context, resetGraph bool) (err error) {
 	log.Printf("[importer] Importer running...")
+	defer func() {
+		if cerr := i.dw.Close(); err == nil {
+			err = cerr
+		}
+	}()
 	if resetGraph {
 		if err := i.resetGraph(); err != nil {
 			return err
 		}
 	}
 
-	zipFiles, err := scrapeZipFiles()
+	return i.importArchives(ctx)
+}
+
+// Retract subtracts the contribution of each named archive from the graph, and
+// removes it from SCRAPED_FILES. The archives are left in RETRACTED, so later
+// imports skip them.
+func (i *Importer) Retract(names []string) (err error) {
+	defer func() {
+		if cerr := i.dw.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	for _, name := range names {
+		log.Printf("[importer] Retracting %v", name)
+		if err := i.dw.RetractFile(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace retracts the named archive, then imports the single archive of the
+// Importer's Source in its place, under the retracted name. The archive is in
+// RETRACTED until its replacement is imported, so an interrupted replacement
+// is not undone by a later import of the original.
+func (i *Importer) Replace(ctx context.Context, name string) (err error) {
+	defer func() {
+		if cerr := i.dw.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	archives, err := i.src.Archives(ctx)
+	if err != nil {
+		return err
+	}
+	if len(archives) != 1 {
+		return fmt.Errorf("expected one replacement archive, found %v", len(archives))
+	}
+	conn, err := i.connPool.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := i.checkBuckets(conn); err != nil {
+		return err
+	}
+
+	log.Printf("[importer] Replacing %v with %v", name, archives[0].Name)
+	if err := i.dw.RetractFile(name); err != nil {
+		return err
+	}
+	i.dw.RecordContributions = i.RecordContributions
+	i.dw.YearCounts = i.YearCounts
+	return i.doImport(ctx, name, archives[0])
+}
+
+// importArchives imports every archive of the Source not yet scraped.
+func (i *Importer) importArchives(ctx context.Context) error {
+	i.dw.RecordContributions = i.RecordContributions
+	i.dw.YearCounts = i.YearCounts
+	archives, err := i.src.Archives(ctx)
 	if err != nil {
 		return err
 	}
@@ -50,23 +143,43 @@ func (i *Importer) Run(resetGraph bool) error {
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
+	if err := i.checkBuckets(conn); err != nil {
+		return err
+	}
 
-	defer i.dw.Close()
-	for idx, zipUrl := range zipFiles {
-		resp, err := redis.Int(conn.Do("SISMEMBER", "SCRAPED_FILES", zipUrl))
+	for idx, a := range archives {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		retracted, err := redis.Bool(conn.Do("SISMEMBER", i.keys.Retracted(), a.Name))
 		if err != nil {
 			return err
 		}
-		if resp > 0 {
-			log.Printf("[importer] Already scraped %v", zipUrl)
+		if retracted {
+			log.Printf("[importer] Skipping retracted %v", a.Name)
 			continue
 		}
-		log.Printf("[importer] Scraping %v/%v: %v", idx+1, len(zipFiles), zipUrl)
-		if err := i.doImport(zipUrl); err != nil {
+		resp, err := redis.Int(conn.Do("SISMEMBER", i.keys.ScrapedFiles(), a.Name))
+		if err != nil {
 			return err
 		}
-		_, err = conn.Do("SADD", "SCRAPED_FILES", zipUrl)
-		if err != nil {
+		if resp > 0 {
+			changed, err := i.archiveChanged(conn, a)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				log.Printf("[importer] Already scraped %v", a.Name)
+				continue
+			}
+			log.Printf("[importer] %v has changed, retracting its previous import", a.Name)
+			if err := i.dw.RetractFile(a.Name); err != nil {
+				return err
+			}
+		}
+		log.Printf("[importer] Scraping %v/%v: %v", idx+1, len(archives), a.Name)
+		if err := i.doImport(ctx, a.Name, a); err != nil {
 			return err
 		}
 	}
@@ -74,21 +187,95 @@ func (i *Importer) Run(resetGraph bool) error {
 	return nil
 }
 
+// checkBuckets records the graph's bucket convention, or checks it matches
+// the one the graph was built with. A graph with scraped files but no
+// convention predates it, so its edges may lack buckets of the convention.
+func (i *Importer) checkBuckets(conn redis.Conn) error {
+	if i.Location == nil {
+		loc, err := time.LoadLocation(DefaultTimeZone)
+		if err != nil {
+			return err
+		}
+		i.Location = loc
+	}
+	want := bucketConvention(i.Location, i.YearCounts)
+	wantJSON, err := json.Marshal(want)
+	if err != nil {
+		return err
+	}
+	haveJSON, err := redis.Bytes(conn.Do("GET", i.keys.Buckets()))
+	if err == redis.ErrNil {
+		var scraped int
+		if scraped, err = redis.Int(conn.Do("SCARD", i.keys.ScrapedFiles())); err != nil {
+			return err
+		}
+		if scraped > 0 {
+			return fmt.Errorf("graph %v has %v scraped files but no bucket convention; rebuild it to record one", i.keys.Graph, scraped)
+		}
+		if _, err := conn.Do("SETNX", i.keys.Buckets(), wantJSON); err != nil {
+			return err
+		}
+		haveJSON, err = redis.Bytes(conn.Do("GET", i.keys.Buckets()))
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(haveJSON, wantJSON) {
+		return fmt.Errorf("graph %v is bucketed as %s, not %s; rebuild it to change", i.keys.Graph, haveJSON, wantJSON)
+	}
+	return nil
+}
+
+func (i *Importer) archiveChanged(conn redis.Conn, a Archive) (bool, error) {
+	if !i.ReimportChanged {
+		return false, nil
+	}
+	reportJSON, err := redis.Bytes(conn.Do("HGET", i.keys.FileReports(), a.Name))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var report FileReport
+	if err := json.Unmarshal(reportJSON, &report); err != nil {
+		return false, err
+	}
+	return report.changed(a), nil
+}
+
 func (i *Importer) resetGraph() error {
-	log.Printf("[importer] Resetting graph!")
+	log.Printf("[importer] Resetting graph %v!", i.keys.Graph)
 	conn, err := i.connPool.Dial()
 	if err != nil {
 		return err
 	}
 
-	if _, err = redis.Int(conn.Do("DEL", "SCRAPED_FILES")); err != nil {
+	if _, err = redis.Int(conn.Do("DEL", i.keys.ScrapedFiles(), i.keys.FileReports())); err != nil {
 		return err
 	}
-	if _, err = redis.Int(conn.Do("DEL", "trips")); err != nil {
+	if _, err = redis.Int(conn.Do("DEL", i.keys.Trips())); err != nil {
 		return err
 	}
+	if _, err = redis.Int(conn.Do("DEL", i.keys.ImportProgress(), i.keys.ImportWindow(), i.keys.Buckets(), i.keys.Bikes(), i.keys.StationHistory(), i.keys.Retracted(), i.keys.Verified())); err != nil {
+		return err
+	}
+	edgeKeys, err := redis.Strings(conn.Do("KEYS", i.keys.ImportEdges("*")))
+	if err != nil {
+		return err
+	}
+	contribKeys, err := redis.Strings(conn.Do("KEYS", i.keys.Contrib("*")))
+	if err != nil {
+		return err
+	}
+	edgeKeys = append(edgeKeys, contribKeys...)
+	if len(edgeKeys) > 0 {
+		if _, err = redis.Int(conn.Do("DEL", redis.Args{}.AddFlat(edgeKeys)...)); err != nil {
+			return err
+		}
+	}
 
-	graph := rg.GraphNew("journeys", conn)
+	graph := rg.GraphNew(i.keys.Graph, conn)
 	if err := graph.Delete(); err != nil {
 		log.Printf("graph.Delete failed: %v", err)
 	}
@@ -102,67 +289,161 @@ func (i *Importer) resetGraph() error {
 	return nil
 }
 
-func (i *Importer) doImport(zipUrl string) error {
-	tdr, err := NewTripdataReader(zipUrl)
+// Verify checks the Importer's graph with VerifyGraph.
+func (i *Importer) Verify() error {
+	return VerifyGraph(i.connPool, i.keys.Graph)
+}
+
+// VerifyGraph checks that a graph was fully built, and is fit to be activated:
+// no file is part way imported, the trips counter matches the file reports
+// and the trips counted by the :Trip edges, and the graph has stations and
+// edges. If so, the graph is marked as verified until it is next written.
+func VerifyGraph(connPool *redis.Pool, graphName string) error {
+	conn, err := connPool.Dial()
 	if err != nil {
 		return err
 	}
-	defer tdr.Close()
-	tripCount := 0
-	for {
-		t, err := tdr.Read()
-		if err == io.EOF {
-			break
+	defer conn.Close()
+	keys := Keys{Graph: graphName}
+
+	inProgress, err := redis.Int(conn.Do("HLEN", keys.ImportProgress()))
+	if err != nil {
+		return err
+	}
+	if inProgress > 0 {
+		return fmt.Errorf("graph %v has %v files part way imported", keys.Graph, inProgress)
+	}
+	reports, err := redis.ByteSlices(conn.Do("HVALS", keys.FileReports()))
+	if err != nil {
+		return err
+	}
+	if len(reports) == 0 {
+		return fmt.Errorf("graph %v has no scraped files", keys.Graph)
+	}
+	reportTrips := 0
+	for _, reportJSON := range reports {
+		var report FileReport
+		if err := json.Unmarshal(reportJSON, &report); err != nil {
+			return err
 		}
+		reportTrips += report.Trips
+	}
+	trips, err := redis.Int(conn.Do("GET", keys.Trips()))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if trips != reportTrips {
+		return fmt.Errorf("graph %v has %v trips, but its file reports sum to %v", keys.Graph, trips, reportTrips)
+	}
+
+	graph := rg.GraphNew(keys.Graph, conn)
+	for _, q := range []string{"MATCH (s:Station) RETURN count(s)", "MATCH ()-[t:Trip]->() RETURN count(t)"} {
+		res, err := graph.Query(q)
 		if err != nil {
 			return err
 		}
-		i.dw.WriteTrip(t)
-		tripCount++
+		if !res.Next() {
+			return fmt.Errorf("%v: no result", q)
+		}
+		if n, _ := res.Record().GetByIndex(0).(int); n == 0 {
+			return fmt.Errorf("graph %v is empty: %v", keys.Graph, q)
+		}
 	}
-	log.Printf("[importer] Wrote %v trips", tripCount)
-
+	// Edge updates which failed after their batch committed are counted by
+	// the trips counter, but not by the edges.
+	res, err := graph.Query("MATCH ()-[t:Trip]->() UNWIND t.counts AS c RETURN sum(c)")
+	if err != nil {
+		return err
+	}
+	if !res.Next() {
+		return fmt.Errorf("graph %v: no result summing edge counts", keys.Graph)
+	}
+	// The sum is a float in some RedisGraph versions.
+	var edgeTrips int
+	switch n := res.Record().GetByIndex(0).(type) {
+	case int:
+		edgeTrips = n
+	case float64:
+		edgeTrips = int(n)
+	}
+	if edgeTrips != trips {
+		return fmt.Errorf("graph %v has %v trips, but its edges count %v", keys.Graph, trips, edgeTrips)
+	}
+	if _, err := conn.Do("SET", keys.Verified(), time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	log.Printf("[importer] Verified graph %v: %v files, %v trips", keys.Graph, len(reports), trips)
 	return nil
 }
 
-type listObjectsContents struct {
-	Key          string
-	LastModified time.Time
-	Size         int64
-}
-
-type listObjectsResp struct {
-	Name     string
-	Contents []listObjectsContents
-}
-
-func scrapeZipFiles() ([]string, error) {
-	resp, err := http.Get(citiBikeBucket)
+// doImport imports an archive as the named file. The name differs from the
+// archive's if it replaces another.
+func (i *Importer) doImport(ctx context.Context, name string, a Archive) error {
+	path, cleanup, err := i.src.Fetch(ctx, a)
 	if err != nil {
-		return []string{}, fmt.Errorf("GET error: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return []string{}, fmt.Errorf("status error: %v", resp.StatusCode)
+	defer cleanup()
+	tdr, err := NewTripdataReader(path)
+	if err != nil {
+		return err
 	}
-
-	data, err := ioutil.ReadAll(resp.Body)
+	defer tdr.Close()
+	tdr.SetDecoders(i.Decoders)
+	tdr.SetLocation(i.Location)
+	tdr.SetRules(i.Rules)
+	if i.Mapping != nil {
+		tdr.SetMapping(i.Mapping)
+	}
+	if i.QuarantineDir != "" {
+		if err := os.MkdirAll(i.QuarantineDir, 0755); err != nil {
+			return err
+		}
+		q, err := os.Create(filepath.Join(i.QuarantineDir, filepath.Base(a.Name)+".rejected.csv"))
+		if err != nil {
+			return err
+		}
+		defer q.Close()
+		tdr.SetQuarantine(q)
+	}
+	skip, err := i.dw.StartFile(name)
 	if err != nil {
-		return []string{}, fmt.Errorf("read body: %v", err)
+		return err
 	}
-
-	var objects listObjectsResp
-	if err := xml.Unmarshal(data, &objects); err != nil {
-		return []string{}, err
+	if err := tdr.Skip(skip); err != nil {
+		return err
 	}
-
-	var result []string
-	for _, c := range objects.Contents {
-		if !strings.HasSuffix(c.Key, ".zip") {
-			continue
+	for {
+		if err := ctx.Err(); err != nil {
+			log.Printf("[importer] Interrupted, checkpointing %v", name)
+			if cerr := i.dw.Checkpoint(tdr.Rows()); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+		t, err := tdr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
 		}
-		result = append(result, citiBikeBucket+c.Key)
+		if err := i.dw.WriteTrip(t, tdr.Rows()-1); err != nil {
+			return err
+		}
+	}
+	report := tdr.Report()
+	report.File = name
+	if name != a.Name {
+		report.Replacement = a.Name
 	}
-	return result, nil
+	report.Size = a.Size
+	report.LastModified = a.LastModified
+	report.ETag = a.ETag
+	report.Log()
+	if err := i.dw.FinishFile(report); err != nil {
+		return err
+	}
+
+	return nil
 }
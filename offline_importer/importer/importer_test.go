@@ -0,0 +1,207 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testSource lists fixed archives, which are already on disk.
+type testSource []Archive
+
+func (s testSource) Archives(_ context.Context) ([]Archive, error) {
+	return s, nil
+}
+
+func (s testSource) Fetch(_ context.Context, a Archive) (string, func(), error) {
+	return a.Path, func() {}, nil
+}
+
+// s3Archive is the fixture, listed as an archive of the S3 bucket.
+func s3Archive(t *testing.T) Archive {
+	fi, err := os.Stat(fixtureArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Archive{
+		Name:         "https://s3.amazonaws.com/tripdata/201307-citibike-tripdata.zip",
+		URL:          "https://s3.amazonaws.com/tripdata/201307-citibike-tripdata.zip",
+		Path:         fixtureArchive,
+		Size:         fi.Size(),
+		LastModified: time.Date(2013, 8, 1, 0, 0, 0, 0, time.UTC),
+		ETag:         `"fixture"`,
+	}
+}
+
+const testGraph = "test"
+
+func newTestImporter(t *testing.T, r *fakeRedis, src Source) *Importer {
+	t.Helper()
+	imp, err := NewImporter(r.pool(), src, testGraph, 2, 100, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imp.RecordContributions = true
+	return imp
+}
+
+// checkState checks the trips counter and the scraped files of the graph.
+func checkState(t *testing.T, r *fakeRedis, trips string, scraped ...string) {
+	t.Helper()
+	keys := Keys{Graph: testGraph}
+	if got := r.strings[keys.Trips()]; got != trips {
+		t.Errorf("got %v trips, want %v", got, trips)
+	}
+	if got := len(r.sets[keys.ScrapedFiles()]); got != len(scraped) {
+		t.Errorf("got %v scraped files, want %v", got, len(scraped))
+	}
+	for _, f := range scraped {
+		if !r.sets[keys.ScrapedFiles()][f] {
+			t.Errorf("%v is not scraped", f)
+		}
+	}
+}
+
+func TestRetractThenRerun(t *testing.T) {
+	r := newFakeRedis()
+	ctx := context.Background()
+	a := s3Archive(t)
+	if err := newTestImporter(t, r, testSource{a}).Run(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, r, "5992", a.Name)
+
+	if err := newTestImporter(t, r, testSource{a}).Retract([]string{a.Name}); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, r, "0")
+
+	// The retracted archive is still in the bucket, but is not imported again.
+	for _, reimport := range []bool{false, true} {
+		imp := newTestImporter(t, r, testSource{a})
+		imp.ReimportChanged = reimport
+		if err := imp.Run(ctx, false); err != nil {
+			t.Fatal(err)
+		}
+		checkState(t, r, "0")
+	}
+}
+
+func TestReplaceThenRerun(t *testing.T) {
+	r := newFakeRedis()
+	ctx := context.Background()
+	a := s3Archive(t)
+	if err := newTestImporter(t, r, testSource{a}).Run(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "fixed.zip")
+	writeZip(t, path, []zipMember{{"fixed.csv", twoTrips}})
+	fixed, err := NewLocalSource([]string{path}).Archives(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestImporter(t, r, testSource(fixed)).Replace(ctx, a.Name); err != nil {
+		t.Fatal(err)
+	}
+	// The replacement is recorded under the replaced name.
+	checkState(t, r, "2", a.Name)
+	var report FileReport
+	if err := json.Unmarshal([]byte(r.hashes[Keys{Graph: testGraph}.FileReports()][a.Name]), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Trips != 2 || report.Replacement != fixed[0].Name {
+		t.Errorf("got report of %v trips replaced by %q, want 2 trips replaced by %q", report.Trips, report.Replacement, fixed[0].Name)
+	}
+
+	// Neither a rerun, nor a rerun re-importing changed archives, imports the
+	// original again.
+	for _, reimport := range []bool{false, true} {
+		imp := newTestImporter(t, r, testSource{a})
+		imp.ReimportChanged = reimport
+		if err := imp.Run(ctx, false); err != nil {
+			t.Fatal(err)
+		}
+		checkState(t, r, "2", a.Name)
+	}
+}
+
+func TestActivateRequiresVerified(t *testing.T) {
+	r := newFakeRedis()
+	conn := r.pool().Get()
+	defer conn.Close()
+	graph, err := NewGraphVersion(conn, DefaultDataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.strings[graph] = "graph"
+	if err := Activate(conn, DefaultDataset, graph); err == nil {
+		t.Errorf("activated %v before it was verified", graph)
+	}
+	r.strings[Keys{Graph: graph}.Verified()] = "2021-06-01T00:00:00Z"
+	if err := Activate(conn, DefaultDataset, graph); err != nil {
+		t.Fatal(err)
+	}
+	if active, err := ActiveGraph(conn, DefaultDataset); err != nil || active != graph {
+		t.Errorf("got active graph %v, %v; want %v", active, err, graph)
+	}
+}
+
+func TestImportUnverifies(t *testing.T) {
+	r := newFakeRedis()
+	verified := Keys{Graph: testGraph}.Verified()
+	r.strings[verified] = "2021-06-01T00:00:00Z"
+	if err := newTestImporter(t, r, testSource{s3Archive(t)}).Run(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.strings[verified]; ok {
+		t.Errorf("graph is still verified after an import")
+	}
+}
+
+func TestNewImporterRejectsBadSizes(t *testing.T) {
+	pool := newFakeRedis().pool()
+	for _, tt := range []struct{ workers, batch int }{{0, 100}, {-1, 100}, {1, 0}, {1, -1}} {
+		if _, err := NewImporter(pool, testSource{}, testGraph, tt.workers, tt.batch, 0, false); err == nil {
+			t.Errorf("%v workers, batches of %v: got no error", tt.workers, tt.batch)
+		}
+	}
+}
+
+func TestCheckDataset(t *testing.T) {
+	for _, id := range []string{DefaultDataset, "jc", "sf-2"} {
+		if err := CheckDataset(id); err != nil {
+			t.Errorf("CheckDataset(%q) = %v, want nil", id, err)
+		}
+	}
+	for _, id := range []string{"", "journeys", "trips", "jc_v1", "jc:x", "JC", "2jc"} {
+		if err := CheckDataset(id); err == nil {
+			t.Errorf("CheckDataset(%q) = nil, want an error", id)
+		}
+	}
+}
+
+func TestYearCountsRecordedInBuckets(t *testing.T) {
+	r := newFakeRedis()
+	ctx := context.Background()
+	a := s3Archive(t)
+	if err := newTestImporter(t, r, testSource{a}).Run(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	var b BucketConvention
+	if err := json.Unmarshal([]byte(r.strings[Keys{Graph: testGraph}.Buckets()]), &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.YearCounts {
+		t.Errorf("BUCKETS records year counts, which were not imported")
+	}
+	// A graph cannot mix files with and without year counts.
+	imp := newTestImporter(t, r, testSource{a})
+	imp.YearCounts = true
+	if err := imp.Run(ctx, false); err == nil {
+		t.Errorf("imported year counts into a graph without them")
+	}
+}
@@ -0,0 +1,164 @@
+package importer
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// LegacyGraph is the graph built before versioned graphs. Its keys are not
+// prefixed, and it is served if the default dataset's ACTIVE_GRAPH is unset.
+const LegacyGraph = "journeys"
+
+// ActiveGraphKey holds the name of the graph served by the backend, prefixed
+// by the dataset unless it is DefaultDataset.
+const ActiveGraphKey = "ACTIVE_GRAPH"
+
+// Keys names the graph and Redis keys of one graph version. Keys of any graph
+// but LegacyGraph, such as the version "journeys_v7" or the base graph "jc" of
+// another dataset, are prefixed, e.g. "journeys_v7:trips", so graphs can be
+// built side by side.
+type Keys struct {
+	Graph string
+}
+
+func (k Keys) prefixed(name string) string {
+	if k.Graph == LegacyGraph {
+		return name
+	}
+	return k.Graph + ":" + name
+}
+
+func (k Keys) Trips() string          { return k.prefixed("trips") }
+func (k Keys) ScrapedFiles() string   { return k.prefixed("SCRAPED_FILES") }
+func (k Keys) FileReports() string    { return k.prefixed("FILE_REPORTS") }
+func (k Keys) ImportProgress() string { return k.prefixed("IMPORT_PROGRESS") }
+func (k Keys) ImportWindow() string   { return k.prefixed("IMPORT_WINDOW") }
+func (k Keys) Buckets() string        { return k.prefixed("BUCKETS") }
+func (k Keys) Bikes() string          { return k.prefixed("BIKES") }
+func (k Keys) StationHistory() string { return k.prefixed("STATION_HISTORY") }
+
+// Retracted is the set of archives which were retracted, and must not be
+// imported again unless replaced.
+func (k Keys) Retracted() string { return k.prefixed("RETRACTED") }
+
+// Verified is set when the graph passes VerifyGraph, and deleted as soon as
+// the graph is written again.
+func (k Keys) Verified() string { return k.prefixed("VERIFIED") }
+
+// ImportEdges is the set of edges written in the current window of a file.
+func (k Keys) ImportEdges(file string) string { return k.prefixed("IMPORT_EDGES:" + file) }
+
+// Contrib is the list of a file's recorded contributions.
+func (k Keys) Contrib(file string) string { return k.prefixed("CONTRIB:" + file) }
+
+// DefaultDataset is the dataset of the graphs built before datasets: all of
+// Citi Bike. Its keys are not prefixed, its first graph is LegacyGraph, and it
+// is served if a request names no dataset.
+const DefaultDataset = "citibike"
+
+// DatasetsKey is the set of datasets built by the importer.
+const DatasetsKey = "DATASETS"
+
+var datasetPattern = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// reservedDatasets are the unprefixed lowercase keys of LegacyGraph, which a
+// dataset's base graph of the same name would overwrite.
+var reservedDatasets = []string{LegacyGraph, Keys{LegacyGraph}.Trips()}
+
+// CheckDataset returns an error if a dataset id is malformed. Ids are
+// lowercase, and cannot contain "_" or ":", so their graph names never collide.
+// Uppercase keys, such as SCRAPED_FILES, cannot collide with them either.
+func CheckDataset(dataset string) error {
+	if !datasetPattern.MatchString(dataset) {
+		return fmt.Errorf("bad dataset id %q: expected lowercase letters, digits and '-'", dataset)
+	}
+	for _, r := range reservedDatasets {
+		if dataset == r {
+			return fmt.Errorf("bad dataset id %q: reserved by graph %v", dataset, LegacyGraph)
+		}
+	}
+	return nil
+}
+
+// datasetKey names a key of a dataset, such as its ACTIVE_GRAPH.
+func datasetKey(dataset, name string) string {
+	if dataset == DefaultDataset {
+		return name
+	}
+	return dataset + ":" + name
+}
+
+// BaseGraph is the graph of a dataset which is not a version, and is served
+// until a version is activated: LegacyGraph for DefaultDataset, or else the
+// dataset id.
+func BaseGraph(dataset string) string {
+	if dataset == DefaultDataset {
+		return LegacyGraph
+	}
+	return dataset
+}
+
+// RegisterDataset adds a dataset to DATASETS, so it is listed by the backend.
+func RegisterDataset(conn redis.Conn, dataset string) error {
+	_, err := conn.Do("SADD", DatasetsKey, dataset)
+	return err
+}
+
+// ActiveGraph returns the name of the dataset's graph served by the backend.
+func ActiveGraph(conn redis.Conn, dataset string) (string, error) {
+	g, err := redis.String(conn.Do("GET", datasetKey(dataset, ActiveGraphKey)))
+	if err == redis.ErrNil {
+		return BaseGraph(dataset), nil
+	}
+	return g, err
+}
+
+// NewGraphVersion allocates the name of a new graph version of a dataset,
+// such as "journeys_v7" or "jc_v2". Versions are listed in the dataset's
+// GRAPH_VERSIONS set, and retained for rollback.
+func NewGraphVersion(conn redis.Conn, dataset string) (string, error) {
+	v, err := redis.Int(conn.Do("INCR", datasetKey(dataset, "GRAPH_VERSION")))
+	if err != nil {
+		return "", err
+	}
+	graph := BaseGraph(dataset) + "_v" + strconv.Itoa(v)
+	if _, err := conn.Do("SADD", datasetKey(dataset, "GRAPH_VERSIONS"), graph); err != nil {
+		return "", err
+	}
+	return graph, nil
+}
+
+// Activate atomically points the backend at an existing graph of a dataset.
+// A version must have passed VerifyGraph since it was last written.
+func Activate(conn redis.Conn, dataset, graph string) error {
+	exists, err := redis.Bool(conn.Do("EXISTS", graph))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("graph %v does not exist", graph)
+	}
+	if graph != BaseGraph(dataset) {
+		version, err := redis.Bool(conn.Do("SISMEMBER", datasetKey(dataset, "GRAPH_VERSIONS"), graph))
+		if err != nil {
+			return err
+		}
+		if !version {
+			return fmt.Errorf("graph %v is not a version of dataset %v", graph, dataset)
+		}
+		verified, err := redis.Bool(conn.Do("EXISTS", Keys{graph}.Verified()))
+		if err != nil {
+			return err
+		}
+		if !verified {
+			return fmt.Errorf("graph %v was not verified since it was last written", graph)
+		}
+	}
+	if _, err := conn.Do("SET", datasetKey(dataset, ActiveGraphKey), graph); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package importer
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A Mapping describes the trip data exports of one bike-share system: where
+// its archives are published, and how its CSV columns map onto Trip fields.
+// Mappings are JSON files; those in mappings/ are built in.
+type Mapping struct {
+	Name string
+	// The S3 bucket listing the system's archives.
+	Bucket string
+	// The zone of trip times without an offset.
+	TimeZone string
+	// The time layouts of the exports, in Go's reference time. Each file's
+	// layout is detected among them, in order of preference. Fractional
+	// seconds, as in "2016-10-01 00:00:06.8580", are accepted by any layout
+	// with seconds. Times in layouts with an offset or zone, such as
+	// "-07:00" or "MST", are converted to TimeZone.
+	TimeLayouts []string
+	// The bounding box of the system's stations, as
+	// "minLat,minLong,maxLat,maxLong". By default, the bbox rule rejects trips
+	// with stations outside it; without one, the rule is off.
+	BoundingBox string `json:",omitempty"`
+	// The CSV schemas of the exports, tried in order against each header.
+	Schemas []MappingSchema
+	// Datasets which import a subset of the system's archives, e.g. one city,
+	// keyed by dataset id. Each is a regular expression matching the base
+	// names of its archives.
+	Datasets map[string]string `json:",omitempty"`
+
+	schemas  []schema
+	datasets map[string]*regexp.Regexp
+}
+
+// A MappingSchema maps the CSV header of one era of exports onto Trip fields.
+type MappingSchema struct {
+	Name string
+	// "int" if station ids are integers, which are normalised (e.g. "72.0"
+	// becomes "72") and rows with other ids rejected. By default, "string".
+	IdType string `json:",omitempty"`
+	// The accepted column names of each Trip field, e.g. "StartTime":
+	// ["starttime", "start time"]. Names are matched case-insensitively. The
+	// RiderType, RideableType and BikeId fields are optional.
+	Columns map[string][]string
+}
+
+// DefaultMapping is the built-in mapping of Citi Bike System Data.
+const DefaultMapping = "citibike"
+
+//go:embed mappings/*.json
+var builtinMappings embed.FS
+
+// The mapping of readers without SetMapping.
+var defaultMapping *Mapping
+
+func init() {
+	var err error
+	if defaultMapping, err = LoadMapping(DefaultMapping); err != nil {
+		panic(err)
+	}
+}
+
+// LoadMapping loads a built-in mapping by name, such as "citibike", or else a
+// mapping file by path.
+func LoadMapping(name string) (*Mapping, error) {
+	data, err := builtinMappings.ReadFile(path.Join("mappings", name+".json"))
+	if err != nil {
+		if data, err = os.ReadFile(name); err != nil {
+			return nil, err
+		}
+	}
+	var m Mapping
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("mapping %v: %w", name, err)
+	}
+	if err := m.compile(); err != nil {
+		return nil, fmt.Errorf("mapping %v: %w", name, err)
+	}
+	return &m, nil
+}
+
+// DatasetSource returns the archives of src in a dataset. If the mapping
+// declares the dataset, only its archives are listed; otherwise every archive
+// is.
+func (m *Mapping) DatasetSource(dataset string, src Source) Source {
+	re, ok := m.datasets[dataset]
+	if !ok {
+		return src
+	}
+	return &filteredSource{src, re}
+}
+
+// compile checks the mapping, and builds its schemas.
+func (m *Mapping) compile() error {
+	if _, err := time.LoadLocation(m.TimeZone); err != nil || m.TimeZone == "" {
+		return fmt.Errorf("bad TimeZone %q", m.TimeZone)
+	}
+	if len(m.TimeLayouts) == 0 {
+		return fmt.Errorf("no TimeLayouts")
+	}
+	if len(m.Schemas) == 0 {
+		return fmt.Errorf("no Schemas")
+	}
+	if m.BoundingBox != "" {
+		if err := new(Rules).SetBoundingBox(m.BoundingBox); err != nil {
+			return fmt.Errorf("bad BoundingBox: %w", err)
+		}
+	}
+	m.datasets = make(map[string]*regexp.Regexp, len(m.Datasets))
+	for dataset, pattern := range m.Datasets {
+		if err := CheckDataset(dataset); err != nil {
+			return err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("dataset %v: %w", dataset, err)
+		}
+		m.datasets[dataset] = re
+	}
+	fields := make(map[string]field, numFields)
+	for f, name := range fieldNames {
+		fields[name] = field(f)
+	}
+	m.schemas = make([]schema, len(m.Schemas))
+	for i, ms := range m.Schemas {
+		sc := &m.schemas[i]
+		sc.name = ms.Name
+		switch ms.IdType {
+		case "", "string":
+		case "int":
+			sc.intIds = true
+		default:
+			return fmt.Errorf("schema %v: unknown IdType %q", ms.Name, ms.IdType)
+		}
+		for name, cols := range ms.Columns {
+			f, ok := fields[name]
+			if !ok {
+				return fmt.Errorf("schema %v: unknown field %q", ms.Name, name)
+			}
+			for _, col := range cols {
+				sc.columns[f] = append(sc.columns[f], strings.ToLower(strings.TrimSpace(col)))
+			}
+		}
+		for f := field(0); f < numFields; f++ {
+			if len(sc.columns[f]) == 0 && !optionalFields[f] {
+				return fmt.Errorf("schema %v: no columns for %v", ms.Name, fieldNames[f])
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package importer
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// The number of rows in each chunk decoded by a decodePipeline.
+const chunkRows = 4096
+
+// The number of chunks each CSV file may read ahead of the consumer.
+const chunksAhead = 4
+
+// A decodedRow is a parsed row. If err is set, the row was rejected.
+type decodedRow struct {
+	trip   *Trip
+	err    error
+	record []string
+}
+
+// A chunk is a run of consecutive records from one CSV file. It is read by the
+// file's reader goroutine, then parsed by any decoder goroutine.
+type chunk struct {
+	first   bool // Whether this is the first chunk of its file.
+	cols    columns
+	records [][]string
+	err     error // The error which ended the file early, if any.
+
+	rows    []decodedRow
+	decoded chan struct{} // Closed once rows are parsed.
+}
+
+func (c *chunk) decode() {
+	trips := make([]Trip, len(c.records))
+	c.rows = make([]decodedRow, len(c.records))
+	for i, record := range c.records {
+		err := c.cols.parse(record, &trips[i])
+		c.rows[i] = decodedRow{trip: &trips[i], err: err, record: record}
+	}
+	close(c.decoded)
+}
+
+// A decodePipeline reads every CSV file of an archive concurrently, and decodes
+// their chunks on a pool of goroutines. Next returns the rows in file order.
+type decodePipeline struct {
+	files []chan *chunk // The chunks of each file, in order.
+	jobs  chan *chunk
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	mapping *Mapping
+	loc     *time.Location
+	// Called by Next with the time layout of each file, as it starts.
+	onTimeLayout func(layout string)
+
+	cur *chunk
+	pos int
+}
+
+func newDecodePipeline(files []io.ReadCloser, decoders int, mapping *Mapping, loc *time.Location, onTimeLayout func(string)) *decodePipeline {
+	p := &decodePipeline{
+		jobs:         make(chan *chunk, decoders),
+		done:         make(chan struct{}),
+		mapping:      mapping,
+		loc:          loc,
+		onTimeLayout: onTimeLayout,
+	}
+	for _, f := range files {
+		chunks := make(chan *chunk, chunksAhead)
+		p.files = append(p.files, chunks)
+		p.wg.Add(1)
+		go p.readFile(f, chunks)
+	}
+	go func() {
+		// Stop the decoders once every file has been read.
+		p.wg.Wait()
+		close(p.jobs)
+	}()
+	for i := 0; i < decoders; i++ {
+		go func() {
+			for c := range p.jobs {
+				c.decode()
+			}
+		}()
+	}
+	return p
+}
+
+// readFile splits one CSV file into chunks, queueing each for decoding and
+// then for the consumer.
+func (p *decodePipeline) readFile(f io.Reader, chunks chan<- *chunk) {
+	defer p.wg.Done()
+	defer close(chunks)
+	c := newCsvReader(f)
+	header, err := c.Read()
+	if err == io.EOF {
+		return // An empty file.
+	}
+	var cols columns
+	if err == nil {
+		var sc *schema
+		var idx [numFields]int
+		if sc, idx, err = p.mapping.detectSchema(header); err == nil {
+			log.Printf("[tripdata_reader] Detected %v schema", sc.name)
+			cols = newColumns(sc, idx, p.mapping.TimeLayouts, p.loc)
+		}
+	}
+	if err != nil {
+		ch := &chunk{err: err, decoded: make(chan struct{})}
+		close(ch.decoded)
+		p.send(chunks, ch)
+		return
+	}
+	for first := true; err == nil; first = false {
+		ch := &chunk{first: first, decoded: make(chan struct{})}
+		for len(ch.records) < chunkRows {
+			var record []string
+			if record, err = c.Read(); err != nil {
+				break
+			}
+			ch.records = append(ch.records, record)
+		}
+		if err != io.EOF {
+			ch.err = err
+		}
+		if first {
+			n := len(ch.records)
+			if n > timeSampleRows {
+				n = timeSampleRows
+			}
+			cols.detectTimeLayout(ch.records[:n])
+		}
+		ch.cols = cols
+		if !p.send(p.jobs, ch) || !p.send(chunks, ch) {
+			return
+		}
+	}
+}
+
+// send sends a chunk, unless the pipeline is closed first.
+func (p *decodePipeline) send(to chan<- *chunk, c *chunk) bool {
+	select {
+	case to <- c:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// Next returns the next decoded row, or io.EOF after the last file.
+func (p *decodePipeline) Next() (decodedRow, error) {
+	for p.cur == nil || p.pos == len(p.cur.rows) {
+		if p.cur != nil && p.cur.err != nil {
+			return decodedRow{}, p.cur.err
+		}
+		if len(p.files) == 0 {
+			return decodedRow{}, io.EOF
+		}
+		c, ok := <-p.files[0]
+		if !ok {
+			p.files = p.files[1:]
+			p.cur = nil
+			continue
+		}
+		<-c.decoded
+		if c.first {
+			p.onTimeLayout(c.cols.timeLayout)
+		}
+		p.cur, p.pos = c, 0
+	}
+	row := p.cur.rows[p.pos]
+	p.pos++
+	return row, nil
+}
+
+// Close stops the pipeline's goroutines. The files are not closed.
+func (p *decodePipeline) Close() {
+	close(p.done)
+	p.wg.Wait()
+}
@@ -0,0 +1,139 @@
+package importer
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A RejectReason categorises why a CSV row was not imported.
+type RejectReason string
+
+const (
+	RejectBadRow           RejectReason = "bad_row" // Too few columns.
+	RejectBadTime          RejectReason = "bad_time"
+	RejectMissingStationId RejectReason = "missing_station_id"
+	RejectBadStationId     RejectReason = "bad_station_id"
+	RejectBadCoordinate    RejectReason = "bad_coordinate"
+)
+
+// A rejectError is returned when a row cannot be parsed into a Trip.
+type rejectError struct {
+	reason RejectReason
+	err    error
+}
+
+func (e *rejectError) Error() string {
+	return fmt.Sprintf("%v: %v", e.reason, e.err)
+}
+
+func (e *rejectError) Unwrap() error {
+	return e.err
+}
+
+func reject(reason RejectReason, format string, a ...interface{}) error {
+	return &rejectError{reason, fmt.Errorf(format, a...)}
+}
+
+// A FileReport summarises the import of one archive. It is stored as JSON in
+// the FILE_REPORTS hash when the archive is scraped.
+type FileReport struct {
+	File     string
+	Rows     int
+	Trips    int
+	Rejected map[RejectReason]int
+	// The number of trips of each rideable type.
+	RideableTypes map[string]int `json:",omitempty"`
+	// The time layouts detected in the archive's CSV files.
+	TimeLayouts []string `json:",omitempty"`
+	// The number of trips which broke each data-quality rule, by the rule's
+	// action. Rejected trips are also counted in Rejected.
+	RuleHits map[string]map[RuleAction]int `json:",omitempty"`
+
+	// The archive's metadata when imported, to detect changed archives.
+	Size         int64
+	LastModified time.Time
+	ETag         string `json:",omitempty"`
+	// The name of the archive imported in place of File, if it was replaced.
+	Replacement string `json:",omitempty"`
+}
+
+func newFileReport(file string) *FileReport {
+	return &FileReport{
+		File:          file,
+		Rejected:      make(map[RejectReason]int),
+		RideableTypes: make(map[string]int),
+		RuleHits:      make(map[string]map[RuleAction]int),
+	}
+}
+
+// changed returns true if the archive differs from the one this report was
+// made for. Reports without metadata, or of replacements, are never considered
+// changed.
+func (fr *FileReport) changed(a Archive) bool {
+	if fr.Size == 0 || fr.Replacement != "" {
+		return false
+	}
+	if fr.ETag != "" && a.ETag != "" {
+		return fr.ETag != a.ETag
+	}
+	return fr.Size != a.Size || !fr.LastModified.Equal(a.LastModified)
+}
+
+func (fr *FileReport) RejectedRows() int {
+	n := 0
+	for _, c := range fr.Rejected {
+		n += c
+	}
+	return n
+}
+
+// Log prints a one line summary of the report.
+func (fr *FileReport) Log() {
+	var reasons []string
+	for r := range fr.Rejected {
+		reasons = append(reasons, string(r))
+	}
+	sort.Strings(reasons)
+	summary := ""
+	for _, r := range reasons {
+		summary += fmt.Sprintf(" %v=%v", r, fr.Rejected[RejectReason(r)])
+	}
+	var rules []string
+	for rule := range fr.RuleHits {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		for _, action := range []RuleAction{ActionClamp, ActionFlag} {
+			if n := fr.RuleHits[rule][action]; n > 0 {
+				summary += fmt.Sprintf(" %v:%v=%v", rule, action, n)
+			}
+		}
+	}
+	log.Printf("[report] %v: %v rows, %v trips, %v rejected%v",
+		fr.File, fr.Rows, fr.Trips, fr.RejectedRows(), summary)
+}
+
+// A quarantineWriter writes rejected rows to a CSV, prefixed by their row
+// number and reject reason.
+type quarantineWriter struct {
+	w *csv.Writer
+}
+
+func newQuarantineWriter(w io.Writer) *quarantineWriter {
+	return &quarantineWriter{w: csv.NewWriter(w)}
+}
+
+func (q *quarantineWriter) Write(row int, reason RejectReason, record []string) error {
+	return q.w.Write(append([]string{strconv.Itoa(row), string(reason)}, record...))
+}
+
+func (q *quarantineWriter) Flush() error {
+	q.w.Flush()
+	return q.w.Error()
+}
@@ -0,0 +1,197 @@
+package importer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A RuleAction is what a data-quality Rule does with a Trip which breaks it.
+type RuleAction string
+
+const (
+	ActionOff    RuleAction = "off"
+	ActionReject RuleAction = "reject" // The row is rejected.
+	ActionClamp  RuleAction = "clamp"  // The Trip is corrected, then imported.
+	ActionFlag   RuleAction = "flag"   // The Trip is imported as is.
+)
+
+// The data-quality rules. Each rule is also the reason of the rows it rejects.
+const (
+	// Both stations must be within the bounding box. Clamping moves a station
+	// to the nearest point of the box.
+	RuleBoundingBox = "bbox"
+	// StopTime must not be before StartTime. Clamping sets it to StartTime.
+	RuleStopBeforeStart = "stop_before_start"
+	// The duration must be at least MinDuration. Clamping lengthens it.
+	RuleMinDuration = "min_duration"
+	// The duration must be at most MaxDuration. Clamping shortens it.
+	RuleMaxDuration = "max_duration"
+)
+
+// The rules, in the order they are applied.
+var ruleNames = []string{RuleBoundingBox, RuleStopBeforeStart, RuleMinDuration, RuleMaxDuration}
+
+// Rules are the data-quality checks applied to each parsed Trip, before it is
+// counted and written. Every Trip which breaks a rule is counted in its
+// FileReport's RuleHits, by rule and action.
+type Rules struct {
+	MinLat, MinLong, MaxLat, MaxLong float64
+	// If 0, there is no minimum or maximum.
+	MinDuration, MaxDuration time.Duration
+	// The action of each rule. Rules without an action are off.
+	Actions map[string]RuleAction
+}
+
+// DefaultRules rejects stations outside the mapping's BoundingBox, such as
+// those at (0, 0), and flags trips which stop before they start or last longer
+// than a day. If the mapping has no BoundingBox, the bbox rule is off.
+func DefaultRules(m *Mapping) *Rules {
+	r := &Rules{
+		MaxDuration: 24 * time.Hour,
+		Actions: map[string]RuleAction{
+			RuleStopBeforeStart: ActionFlag,
+			RuleMaxDuration:     ActionFlag,
+		},
+	}
+	if m.BoundingBox != "" {
+		// The box was checked when the mapping was loaded.
+		r.SetBoundingBox(m.BoundingBox)
+		r.Actions[RuleBoundingBox] = ActionReject
+	}
+	return r
+}
+
+// SetActions sets the actions of rules from a comma-separated list of
+// rule=action, e.g. "bbox=clamp,max_duration=reject".
+func (r *Rules) SetActions(spec string) error {
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("rule %q is not rule=action", s)
+		}
+		name, action := kv[0], RuleAction(kv[1])
+		if !contains(ruleNames, name) {
+			return fmt.Errorf("unknown rule %q, expected one of %v", name, ruleNames)
+		}
+		switch action {
+		case ActionOff, ActionReject, ActionClamp, ActionFlag:
+		default:
+			return fmt.Errorf("unknown action %q of rule %v", action, name)
+		}
+		r.Actions[name] = action
+	}
+	return nil
+}
+
+// SetBoundingBox parses a bounding box of "minLat,minLong,maxLat,maxLong".
+func (r *Rules) SetBoundingBox(spec string) error {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 4 {
+		return fmt.Errorf("bounding box %q is not minLat,minLong,maxLat,maxLong", spec)
+	}
+	var v [4]float64
+	for i, p := range parts {
+		var err error
+		if v[i], err = strconv.ParseFloat(strings.TrimSpace(p), 64); err != nil {
+			return fmt.Errorf("bounding box %q: %w", spec, err)
+		}
+	}
+	if v[0] > v[2] || v[1] > v[3] {
+		return fmt.Errorf("bounding box %q has its minimum after its maximum", spec)
+	}
+	r.MinLat, r.MinLong, r.MaxLat, r.MaxLong = v[0], v[1], v[2], v[3]
+	return nil
+}
+
+// String describes the enabled rules, for logging.
+func (r *Rules) String() string {
+	var s []string
+	for _, name := range ruleNames {
+		if a := r.Actions[name]; a != "" && a != ActionOff {
+			s = append(s, name+"="+string(a))
+		}
+	}
+	return fmt.Sprintf("%v bbox=[%v,%v,%v,%v] durations=[%v,%v]",
+		strings.Join(s, ","), r.MinLat, r.MinLong, r.MaxLat, r.MaxLong, r.MinDuration, r.MaxDuration)
+}
+
+// apply checks a Trip against each rule in turn, clamping it if needed, and
+// counts the rules it breaks in hits. A rejectError is returned if a rule
+// rejects it.
+func (r *Rules) apply(t *Trip, hits map[string]map[RuleAction]int) error {
+	for _, name := range ruleNames {
+		action := r.Actions[name]
+		if action == "" || action == ActionOff || !r.breaks(name, t) {
+			continue
+		}
+		if hits[name] == nil {
+			hits[name] = make(map[RuleAction]int)
+		}
+		hits[name][action]++
+		switch action {
+		case ActionReject:
+			return reject(RejectReason(name), "trip breaks rule %v: %+v", name, *t)
+		case ActionClamp:
+			r.clamp(name, t)
+		}
+	}
+	return nil
+}
+
+func (r *Rules) breaks(name string, t *Trip) bool {
+	switch name {
+	case RuleBoundingBox:
+		return !r.inBox(t.StartStationLat, t.StartStationLong) || !r.inBox(t.EndStationLat, t.EndStationLong)
+	case RuleStopBeforeStart:
+		return t.StopTime.Before(t.StartTime)
+	case RuleMinDuration:
+		return r.MinDuration > 0 && t.StopTime.Sub(t.StartTime) < r.MinDuration
+	case RuleMaxDuration:
+		return r.MaxDuration > 0 && t.StopTime.Sub(t.StartTime) > r.MaxDuration
+	}
+	return false
+}
+
+func (r *Rules) inBox(lat, long float64) bool {
+	return lat >= r.MinLat && lat <= r.MaxLat && long >= r.MinLong && long <= r.MaxLong
+}
+
+func (r *Rules) clamp(name string, t *Trip) {
+	switch name {
+	case RuleBoundingBox:
+		t.StartStationLat = clampFloat(t.StartStationLat, r.MinLat, r.MaxLat)
+		t.StartStationLong = clampFloat(t.StartStationLong, r.MinLong, r.MaxLong)
+		t.EndStationLat = clampFloat(t.EndStationLat, r.MinLat, r.MaxLat)
+		t.EndStationLong = clampFloat(t.EndStationLong, r.MinLong, r.MaxLong)
+	case RuleStopBeforeStart:
+		t.StopTime = t.StartTime
+	case RuleMinDuration:
+		t.StopTime = t.StartTime.Add(r.MinDuration)
+	case RuleMaxDuration:
+		t.StopTime = t.StartTime.Add(r.MaxDuration)
+	}
+}
+
+func clampFloat(v, min, max float64) float64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package importer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A field is a Trip column, located by name in each CSV header.
+type field int
+
+const (
+	fieldStartTime field = iota
+	fieldStopTime
+	fieldStartStationId
+	fieldStartStationName
+	fieldStartStationLat
+	fieldStartStationLong
+	fieldEndStationId
+	fieldEndStationName
+	fieldEndStationLat
+	fieldEndStationLong
+	fieldRiderType    // Optional.
+	fieldRideableType // Optional.
+	fieldBikeId       // Optional.
+	numFields
+)
+
+// Optional fields may be missing from a header. Their column index is then -1.
+var optionalFields = map[field]bool{
+	fieldRiderType:    true,
+	fieldRideableType: true,
+	fieldBikeId:       true,
+}
+
+// The name of each field in mapping files, as in Trip.
+var fieldNames = [numFields]string{
+	fieldStartTime:        "StartTime",
+	fieldStopTime:         "StopTime",
+	fieldStartStationId:   "StartStationId",
+	fieldStartStationName: "StartStationName",
+	fieldStartStationLat:  "StartStationLat",
+	fieldStartStationLong: "StartStationLong",
+	fieldEndStationId:     "EndStationId",
+	fieldEndStationName:   "EndStationName",
+	fieldEndStationLat:    "EndStationLat",
+	fieldEndStationLong:   "EndStationLong",
+	fieldRiderType:        "RiderType",
+	fieldRideableType:     "RideableType",
+	fieldBikeId:           "BikeId",
+}
+
+// A schema maps the CSV header of one era of a system's exports onto Trip
+// fields. Schemas are declared by a Mapping.
+type schema struct {
+	name string
+	// Whether station ids are integers, normalised as such.
+	intIds bool
+	// The accepted (lowercase) column names of each field.
+	columns [numFields][]string
+}
+
+// match returns the column index of every field, if the header matches this schema.
+func (s *schema) match(header []string) (idx [numFields]int, ok bool) {
+	cols := make(map[string]int, len(header))
+	for i, col := range header {
+		// Some exports start with a UTF-8 byte order mark.
+		col = strings.TrimPrefix(col, "\ufeff")
+		cols[strings.ToLower(strings.TrimSpace(col))] = i
+	}
+	for f := field(0); f < numFields; f++ {
+		found := false
+		for _, name := range s.columns[f] {
+			if i, ok := cols[name]; ok {
+				idx[f] = i
+				found = true
+				break
+			}
+		}
+		if !found {
+			if !optionalFields[f] {
+				return idx, false
+			}
+			idx[f] = -1
+		}
+	}
+	return idx, true
+}
+
+// detectSchema returns the first schema of the mapping matching the header.
+func (m *Mapping) detectSchema(header []string) (*schema, [numFields]int, error) {
+	for i := range m.schemas {
+		if idx, ok := m.schemas[i].match(header); ok {
+			return &m.schemas[i], idx, nil
+		}
+	}
+	return nil, [numFields]int{}, fmt.Errorf("header matches no schema of %v: %v", m.Name, header)
+}
@@ -0,0 +1,397 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An Archive is a single trip data file: either a .zip of CSVs, or a bare .csv.
+type Archive struct {
+	// Name identifies the archive in SCRAPED_FILES. This is the URL of a remote
+	// archive, or the absolute path of a local one.
+	Name string
+	// URL is set if the archive must be downloaded by Source.Fetch.
+	URL string
+	// Path is set if the archive is already on disk.
+	Path         string
+	Size         int64
+	LastModified time.Time
+	// ETag is the S3 object's ETag, if known.
+	ETag string
+}
+
+// A Source lists the trip data archives to import, in import order.
+type Source interface {
+	Archives(ctx context.Context) ([]Archive, error)
+	// Fetch returns the path of the archive on disk, downloading it if needed.
+	// The returned cleanup func must be called once the archive is imported.
+	Fetch(ctx context.Context, a Archive) (path string, cleanup func(), err error)
+}
+
+// A filteredSource lists the archives of another Source whose base names match
+// a pattern.
+type filteredSource struct {
+	Source
+	pattern *regexp.Regexp
+}
+
+func (s *filteredSource) Archives(ctx context.Context) ([]Archive, error) {
+	archives, err := s.Source.Archives(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var filtered []Archive
+	for _, a := range archives {
+		if s.pattern.MatchString(path.Base(a.Name)) {
+			filtered = append(filtered, a)
+		}
+	}
+	return filtered, nil
+}
+
+// S3Source lists the .zip archives in a public S3 bucket.
+type S3Source struct {
+	BucketURL string
+	// CacheDir keeps downloaded archives between runs. If empty, archives are
+	// downloaded to temporary files and deleted after import.
+	CacheDir string
+}
+
+func NewS3Source(bucketURL, cacheDir string) *S3Source {
+	if !strings.HasSuffix(bucketURL, "/") {
+		bucketURL += "/"
+	}
+	return &S3Source{BucketURL: bucketURL, CacheDir: cacheDir}
+}
+
+type listObjectsContents struct {
+	Key          string
+	LastModified time.Time
+	ETag         string
+	Size         int64
+}
+
+type listObjectsResp struct {
+	Name                  string
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []listObjectsContents
+}
+
+// Archives lists every .zip in the bucket, following ListObjectsV2 pagination.
+func (s *S3Source) Archives(ctx context.Context) ([]Archive, error) {
+	var result []Archive
+	token := ""
+	for {
+		objects, err := s.listObjects(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range objects.Contents {
+			if !strings.HasSuffix(c.Key, ".zip") {
+				continue
+			}
+			result = append(result, Archive{
+				Name:         s.BucketURL + c.Key,
+				URL:          s.BucketURL + c.Key,
+				Size:         c.Size,
+				LastModified: c.LastModified,
+				ETag:         strings.Trim(c.ETag, `"`),
+			})
+		}
+		if !objects.IsTruncated || objects.NextContinuationToken == "" {
+			return result, nil
+		}
+		token = objects.NextContinuationToken
+	}
+}
+
+// listObjects fetches one page of the bucket listing.
+func (s *S3Source) listObjects(ctx context.Context, token string) (*listObjectsResp, error) {
+	query := url.Values{"list-type": {"2"}}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.BucketURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("GET error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status error: %v", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %v", err)
+	}
+
+	var objects listObjectsResp
+	if err := xml.Unmarshal(data, &objects); err != nil {
+		return nil, err
+	}
+	return &objects, nil
+}
+
+func (s *S3Source) Fetch(ctx context.Context, a Archive) (string, func(), error) {
+	return fetchRemote(ctx, a, s.CacheDir)
+}
+
+// URLSource lists archives at explicit URLs, e.g. a single corrected archive.
+// They are always downloaded, never cached, as a corrected archive often has
+// the same name as the one it replaces.
+type URLSource struct {
+	URLs []string
+}
+
+func NewURLSource(urls []string) *URLSource {
+	return &URLSource{URLs: urls}
+}
+
+func (s *URLSource) Archives(_ context.Context) ([]Archive, error) {
+	var result []Archive
+	for _, u := range s.URLs {
+		result = append(result, Archive{Name: u, URL: u})
+	}
+	return result, nil
+}
+
+func (s *URLSource) Fetch(ctx context.Context, a Archive) (string, func(), error) {
+	return fetchRemote(ctx, a, "")
+}
+
+// fetchRemote downloads a remote archive to cacheDir, or to a temporary file
+// if cacheDir is empty.
+func fetchRemote(ctx context.Context, a Archive, cacheDir string) (string, func(), error) {
+	noop := func() {}
+	if cacheDir == "" {
+		// Keep the extension, as it tells NewTripdataReader how to read it.
+		f, err := ioutil.TempFile("", "tripdata-*"+archiveExt(a.URL))
+		if err != nil {
+			return "", noop, err
+		}
+		cleanup := func() { os.Remove(f.Name()) }
+		if err := download(ctx, a, f); err != nil {
+			cleanup()
+			return "", noop, err
+		}
+		return f.Name(), cleanup, nil
+	}
+
+	path := filepath.Join(cacheDir, filepath.Base(a.URL))
+	if cached(path, a) {
+		log.Printf("[source] Using cached %v", path)
+		return path, noop, nil
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", noop, err
+	}
+	// Download to a partial file, so an interrupted download is never cached.
+	f, err := os.Create(path + ".part")
+	if err != nil {
+		return "", noop, err
+	}
+	if err := download(ctx, a, f); err != nil {
+		os.Remove(f.Name())
+		return "", noop, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", noop, err
+	}
+	if err := writeCacheMeta(path, a); err != nil {
+		return "", noop, err
+	}
+	return path, noop, nil
+}
+
+// archiveExt returns the extension of the archive at a URL: ".csv", or else
+// ".zip".
+func archiveExt(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && strings.EqualFold(path.Ext(u.Path), ".csv") {
+		return ".csv"
+	}
+	return ".zip"
+}
+
+// A cacheMeta is the listing of a cached archive when it was downloaded. It is
+// kept in a sidecar file next to the archive, so an archive republished with
+// the same size is downloaded again.
+type cacheMeta struct {
+	Size         int64
+	LastModified time.Time
+	ETag         string
+}
+
+func cacheMetaPath(path string) string {
+	return path + ".meta.json"
+}
+
+// cached returns whether the archive cached at path is the listed version of a.
+// Archives cached without a sidecar file are downloaded again.
+func cached(path string, a Archive) bool {
+	fi, err := os.Stat(path)
+	if err != nil || (a.Size > 0 && fi.Size() != a.Size) {
+		return false
+	}
+	data, err := ioutil.ReadFile(cacheMetaPath(path))
+	if err != nil {
+		return false
+	}
+	var meta cacheMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return false
+	}
+	return meta.Size == a.Size && meta.LastModified.Equal(a.LastModified) && meta.ETag == a.ETag
+}
+
+func writeCacheMeta(path string, a Archive) error {
+	data, err := json.Marshal(cacheMeta{a.Size, a.LastModified, a.ETag})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cacheMetaPath(path), data, 0644)
+}
+
+// download streams a remote archive to f, closing it, and verifies the size
+// against the bucket listing.
+func download(ctx context.Context, a Archive, f *os.File) error {
+	defer f.Close()
+	log.Printf("[source] Downloading %v", a.URL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status error: %v", resp.StatusCode)
+	}
+	n, err := io.Copy(f, resp.Body)
+	if err != nil {
+		return err
+	}
+	if a.Size > 0 && n != a.Size {
+		return fmt.Errorf("downloaded %v bytes of %v, expected %v", n, a.URL, a.Size)
+	}
+	return f.Close()
+}
+
+// LocalSource lists .zip and .csv archives already on disk. Each pattern may be
+// a directory (searched recursively), a glob, or a path to a single file.
+type LocalSource struct {
+	Patterns []string
+}
+
+func NewLocalSource(patterns []string) *LocalSource {
+	return &LocalSource{Patterns: patterns}
+}
+
+func (s *LocalSource) Archives(_ context.Context) ([]Archive, error) {
+	var result []Archive
+	seen := make(map[string]bool)
+	for _, pattern := range s.Patterns {
+		paths, err := expandLocalPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				return nil, err
+			}
+			if seen[abs] {
+				continue
+			}
+			seen[abs] = true
+			fi, err := os.Stat(abs)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, Archive{
+				Name:         abs,
+				Path:         abs,
+				Size:         fi.Size(),
+				LastModified: fi.ModTime(),
+			})
+		}
+	}
+	return result, nil
+}
+
+func (s *LocalSource) Fetch(_ context.Context, a Archive) (string, func(), error) {
+	return a.Path, func() {}, nil
+}
+
+func isArchiveFile(path string) bool {
+	if strings.HasPrefix(filepath.Base(path), "_") {
+		return false // Ignore weird __MACOSX files.
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".zip" || ext == ".csv"
+}
+
+// expandLocalPattern returns the sorted archive paths matching a single pattern.
+func expandLocalPattern(pattern string) ([]string, error) {
+	fi, err := os.Stat(pattern)
+	if err == nil && fi.IsDir() {
+		var paths []string
+		err := filepath.Walk(pattern, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && strings.HasPrefix(info.Name(), "_") {
+				return filepath.SkipDir
+			}
+			if !info.IsDir() && isArchiveFile(path) {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(paths)
+		return paths, nil
+	}
+	if err == nil {
+		return []string{pattern}, nil
+	}
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no archives match %q", pattern)
+	}
+	var result []string
+	for _, p := range paths {
+		if isArchiveFile(p) {
+			result = append(result, p)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
@@ -0,0 +1,190 @@
+package importer
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Stations are renamed and relocated over the years, so every name and
+// location seen for a station is kept in STATION_HISTORY, with when it was
+// first and last seen, and how often it was seen each month. A :Station node
+// has the name and location of its current version: the one seen most in
+// recent months, so a single row with jittered coordinates or a misspelled
+// name does not move it. Like BIKES, the history is committed with each file's
+// progress.
+
+// The current version of a station is the one seen most in the last
+// currentMonths calendar months in which the station was seen. A relocation
+// takes effect once the new version has been seen more than the old one over
+// that period.
+const currentMonths = 2
+
+// A stationVersion is a name and location a station was seen with.
+type stationVersion struct {
+	Name        string
+	Lat, Long   float64
+	First, Last time.Time
+	// The number of trips which saw the version in each month, as "2006-01".
+	// Missing in versions recorded before it was kept.
+	Months map[string]int `json:",omitempty"`
+}
+
+// matches reports whether a trip saw this version. Locations within
+// conflictDegrees are the same, as exports round coordinates differently.
+func (v *stationVersion) matches(name string, lat, long float64) bool {
+	return v.Name == name && math.Abs(v.Lat-lat) <= conflictDegrees && math.Abs(v.Long-long) <= conflictDegrees
+}
+
+func monthKey(year int, month time.Month) string {
+	return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC).Format("2006-01")
+}
+
+// currentVersion is the version seen most in the station's last currentMonths
+// months, or nil. Ties go to the most recently seen version.
+func currentVersion(versions []*stationVersion) *stationVersion {
+	var latest time.Time
+	for _, v := range versions {
+		if v.Last.After(latest) {
+			latest = v.Last
+		}
+	}
+	var months [currentMonths]string
+	for i := range months {
+		months[i] = monthKey(latest.Year(), latest.Month()-time.Month(i))
+	}
+	var cur *stationVersion
+	curTrips := 0
+	for _, v := range versions {
+		trips := 0
+		for _, m := range months {
+			trips += v.Months[m]
+		}
+		if cur == nil || trips > curTrips || (trips == curTrips && v.Last.After(cur.Last)) {
+			cur, curTrips = v, trips
+		}
+	}
+	return cur
+}
+
+type stationTracker struct {
+	history map[string][]*stationVersion // The versions of each station, in the order seen.
+	dirty   map[string]bool              // Stations seen since the last sendDirty.
+	seen    map[string]bool              // Stations seen since the last takeChanged.
+	// The version each :Station node has, as of the last takeChanged.
+	placed map[string]*stationVersion
+
+	// The month of the last trip seen, and its key, as trips are mostly in
+	// time order.
+	year  int
+	month time.Month
+	key   string
+}
+
+// loadStations reads the history of every station from key.
+func loadStations(conn redis.Conn, key string) (*stationTracker, error) {
+	m, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+	s := &stationTracker{
+		history: make(map[string][]*stationVersion, len(m)),
+		dirty:   make(map[string]bool),
+		seen:    make(map[string]bool),
+		placed:  make(map[string]*stationVersion, len(m)),
+	}
+	for id, v := range m {
+		var versions []*stationVersion
+		if err := json.Unmarshal([]byte(v), &versions); err != nil {
+			return nil, err
+		}
+		s.history[id] = versions
+		s.placed[id] = currentVersion(versions)
+	}
+	return s, nil
+}
+
+// seeTrip records the stations of a Trip, at its start and stop times.
+func (s *stationTracker) seeTrip(t *Trip) {
+	s.see(t.StartStationId, t.StartStationName, t.StartStationLat, t.StartStationLong, t.StartTime)
+	s.see(t.EndStationId, t.EndStationName, t.EndStationLat, t.EndStationLong, t.StopTime)
+}
+
+func (s *stationTracker) see(id, name string, lat, long float64, at time.Time) {
+	versions := s.history[id]
+	var v *stationVersion
+	for _, vv := range versions {
+		if vv.matches(name, lat, long) {
+			v = vv
+			break
+		}
+	}
+	switch {
+	case v == nil:
+		v = &stationVersion{Name: name, Lat: lat, Long: long, First: at, Last: at}
+		s.history[id] = append(versions, v)
+	case at.Before(v.First):
+		v.First = at
+	case at.After(v.Last):
+		v.Last = at
+	}
+	if v.Months == nil {
+		v.Months = make(map[string]int)
+	}
+	v.Months[s.monthKey(at)]++
+	s.dirty[id] = true
+	s.seen[id] = true
+}
+
+func (s *stationTracker) monthKey(t time.Time) string {
+	if y, m := t.Year(), t.Month(); y != s.year || m != s.month || s.key == "" {
+		s.year, s.month, s.key = y, m, monthKey(y, m)
+	}
+	return s.key
+}
+
+// current returns the current version of a station, or nil.
+func (s *stationTracker) current(id string) *station {
+	v := currentVersion(s.history[id])
+	if v == nil {
+		return nil
+	}
+	return &station{id, v.Name, v.Lat, v.Long}
+}
+
+// takeChanged returns the stations seen since the last call whose current
+// version changed. Stations first seen are also changed, as they may predate
+// the history.
+func (s *stationTracker) takeChanged() []*station {
+	var stations []*station
+	for id := range s.seen {
+		cur := currentVersion(s.history[id])
+		if cur == s.placed[id] {
+			continue
+		}
+		s.placed[id] = cur
+		stations = append(stations, &station{id, cur.Name, cur.Lat, cur.Long})
+	}
+	s.seen = make(map[string]bool)
+	return stations
+}
+
+// sendDirty sends an HSET of the stations seen since the last call, to be
+// committed with the rows they were read from.
+func (s *stationTracker) sendDirty(conn redis.Conn, key string) error {
+	if len(s.dirty) == 0 {
+		return nil
+	}
+	args := redis.Args{key}
+	for id := range s.dirty {
+		v, err := json.Marshal(s.history[id])
+		if err != nil {
+			return err
+		}
+		args = append(args, id, v)
+	}
+	s.dirty = make(map[string]bool)
+	return conn.Send("HSET", args...)
+}
@@ -0,0 +1,50 @@
+package importer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStationCurrentVersion(t *testing.T) {
+	s := &stationTracker{
+		history: make(map[string][]*stationVersion),
+		dirty:   make(map[string]bool),
+		seen:    make(map[string]bool),
+		placed:  make(map[string]*stationVersion),
+	}
+	day := func(month time.Month, d int) time.Time { return time.Date(2020, month, d, 12, 0, 0, 0, time.UTC) }
+	see := func(name string, lat float64, at time.Time) []*station {
+		s.see("72", name, lat, -73.99, at)
+		return s.takeChanged()
+	}
+
+	if changed := see("W 52 St", 40.767, day(1, 1)); len(changed) != 1 {
+		t.Fatalf("first sighting: got %v changed stations, want 1", len(changed))
+	}
+	for d := 2; d <= 20; d++ {
+		see("W 52 St", 40.767, day(1, d))
+	}
+	// A jittered location, then a misspelling, on the latest trips.
+	if changed := see("W 52 St", 40.770, day(1, 21)); len(changed) != 0 {
+		t.Errorf("jittered location moved the station to %+v", changed[0])
+	}
+	if changed := see("W 52 Street", 40.767, day(1, 22)); len(changed) != 0 {
+		t.Errorf("misspelling renamed the station to %+v", changed[0])
+	}
+	see("W 52 St", 40.767, day(1, 23))
+
+	// A relocation moves the station once it outnumbers the old location in
+	// the last two months.
+	var moved []time.Time
+	for _, at := range []time.Time{day(2, 1), day(2, 10), day(2, 20), day(3, 1), day(3, 2)} {
+		if changed := see("W 52 St", 40.780, at); len(changed) > 0 {
+			if changed[0].lat != 40.780 {
+				t.Errorf("moved to %+v, want lat 40.780", changed[0])
+			}
+			moved = append(moved, at)
+		}
+	}
+	if len(moved) != 1 || !moved[0].Equal(day(3, 1)) {
+		t.Errorf("moved at %v, want once at %v", moved, day(3, 1))
+	}
+}
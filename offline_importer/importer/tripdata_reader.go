@@ -2,84 +2,289 @@ package importer
 
 import (
 	"archive/zip"
-	"bytes"
 	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
+	"math"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// Different dumps use different time formats.
-const timeFormat1 = "2006-01-02 15:04:05"
-const timeFormat2 = "1/2/2006 15:04:05"
+// The number of rows at the start of each CSV file used to detect its time
+// layout.
+const timeSampleRows = 100
 
-func parseTime(timeStr string) (time.Time, error) {
-	t, err := time.Parse(timeFormat1, timeStr)
-	if err == nil {
-		return t, nil
+// DefaultTimeZone is the zone of Citi Bike's wall clock times.
+const DefaultTimeZone = "America/New_York"
+
+// inLocation interprets the wall clock time of t in loc. A time in the hour
+// repeated when DST ends is taken as its first occurrence, in daylight time. A
+// time in the hour skipped when DST starts is moved forward by the gap, as a
+// clock would have shown it.
+func inLocation(t time.Time, loc *time.Location) time.Time {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	_, offBefore := wall.Add(-24 * time.Hour).In(loc).Zone()
+	_, offAfter := wall.Add(24 * time.Hour).In(loc).Zone()
+	var first time.Time
+	for _, off := range []int{offBefore, offAfter} {
+		c := wall.Add(-time.Duration(off) * time.Second).In(loc)
+		if sameWallClock(c, wall) && (first.IsZero() || c.Before(first)) {
+			first = c
+		}
+	}
+	if first.IsZero() {
+		// Skipped: the clock still showed the offset before the transition.
+		return wall.Add(-time.Duration(offBefore) * time.Second).In(loc)
+	}
+	return first
+}
+
+func sameWallClock(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	ah, ami, as := a.Clock()
+	bh, bmi, bs := b.Clock()
+	return ay == by && am == bm && ad == bd && ah == bh && ami == bmi && as == bs
+}
+
+// A RiderType is the kind of rider who took a Trip.
+type RiderType int
+
+const (
+	RiderUnknown RiderType = iota
+	RiderMember            // An annual subscriber: "Subscriber" or "member".
+	RiderCasual            // A day pass or single ride: "Customer" or "casual".
+)
+
+func parseRiderType(s string) RiderType {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "subscriber", "member":
+		return RiderMember
+	case "customer", "casual":
+		return RiderCasual
 	}
-	return time.Parse(timeFormat2, timeStr)
+	return RiderUnknown
+}
+
+// A RideableType is the kind of bike of a Trip. Legacy exports do not record
+// it.
+type RideableType int
+
+const (
+	RideableUnknown RideableType = iota
+	RideableClassic
+	RideableElectric
+	RideableDocked
+)
+
+var rideableTypeNames = map[RideableType]string{
+	RideableUnknown:  "unknown",
+	RideableClassic:  "classic_bike",
+	RideableElectric: "electric_bike",
+	RideableDocked:   "docked_bike",
+}
+
+// String is the type's name in the modern exports.
+func (t RideableType) String() string {
+	return rideableTypeNames[t]
+}
+
+func parseRideableType(s string) RideableType {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for t, name := range rideableTypeNames {
+		if t != RideableUnknown && s == name {
+			return t
+		}
+	}
+	return RideableUnknown
 }
 
 // A Trip is a parsed row from the Citi Bike System Data records.
 type Trip struct {
 	StartTime        time.Time
 	StopTime         time.Time
-	StartStationId   int
+	StartStationId   string
 	StartStationName string
 	StartStationLat  float64
 	StartStationLong float64
-	EndStationId     int
+	EndStationId     string
 	EndStationName   string
 	EndStationLat    float64
 	EndStationLong   float64
+	RiderType        RiderType
+	RideableType     RideableType
+	BikeId           string // Empty if the export has no bike ids.
 }
 
-// A TripdataReader downloaded, decompresses, and parses a NYC Bike Trip Data file.
+// A TripdataReader decompresses and parses a NYC Bike Trip Data file.
+//
+// By default, the CSV files of an archive are decoded one after another on the
+// caller's goroutine, reusing one record and one Trip. SetDecoders enables a
+// pipeline which decodes chunks of rows concurrently; rows are still returned,
+// counted and rejected in file order.
 type TripdataReader struct {
-	headerParsed        bool
-	startTimeIdx        int
-	stopTimeIdx         int
-	startStationIdIdx   int
-	startStationNameIdx int
-	startStationLatIdx  int
-	startStationLongIdx int
-	endStationIdIdx     int
-	endStationNameIdx   int
-	endStationLatIdx    int
-	endStationLongIdx   int
-
-	files []io.ReadCloser
-	csv   *csv.Reader
-}
-
-// Creates a new TripdataReader. This function downloads the file and decompresses it before returning.
-func NewTripdataReader(zipUrl string) (*TripdataReader, error) {
-	// Download and open the zip file.
-	resp, err := http.Get(zipUrl)
+	headerParsed bool
+	rows         int // The number of data rows read, across all files.
+	schema       *schema
+	cols         columns // The columns of the current file.
+	trip         Trip    // Reused by each call to Read.
+
+	// The first rows of the current file, read to detect its time layout,
+	// and the error which ended them, if any.
+	sample    [][]string
+	sampleErr error
+
+	report     *FileReport
+	quarantine *quarantineWriter
+	rules      *Rules
+	mapping    *Mapping
+
+	loc      *time.Location // The zone of times without an offset.
+	decoders int
+	pipeline *decodePipeline
+
+	archive io.Closer // The zip file, if any. Closed after all its files.
+	files   []io.ReadCloser
+	csv     *csv.Reader
+}
+
+// columns locates the fields of a Trip in the records of one CSV file.
+type columns struct {
+	idx        [numFields]int // The column index of each field.
+	min        int            // Rows without every required column are rejected.
+	timeLayout string         // The time layout detected for the file.
+	timeZoned  bool           // Whether timeLayout has a zone or offset.
+	layouts    []string       // The time layouts of the mapping.
+	zoned      []bool         // Whether each layout has a zone or offset.
+	intIds     bool           // Whether station ids are integers.
+	loc        *time.Location // Times are returned in this zone.
+}
+
+func newColumns(sc *schema, idx [numFields]int, layouts []string, loc *time.Location) columns {
+	c := columns{idx: idx, layouts: layouts, intIds: sc.intIds, loc: loc}
+	for _, l := range layouts {
+		c.zoned = append(c.zoned, layoutHasZone(l))
+	}
+	for f, i := range idx {
+		if i >= c.min && !optionalFields[field(f)] {
+			c.min = i + 1
+		}
+	}
+	return c
+}
+
+// layoutHasZone reports whether times in a layout have a zone or offset, such
+// as "-07:00", "Z07:00" or "MST", by parsing the reference time with an
+// offset.
+func layoutHasZone(layout string) bool {
+	ref := time.Date(2006, 1, 2, 15, 4, 5, 0, time.FixedZone("MST", -7*60*60))
+	t, err := time.Parse(layout, ref.Format(layout))
+	return err == nil && t.Location() != time.UTC
+}
+
+// detectTimeLayout picks the time layout which parses the most start times in
+// the sample records, preferring earlier layouts.
+func (c *columns) detectTimeLayout(sample [][]string) {
+	best, bestParsed := 0, 0
+	for i, layout := range c.layouts {
+		parsed := 0
+		for _, record := range sample {
+			if len(record) < c.min {
+				continue
+			}
+			if _, err := time.Parse(layout, record[c.idx[fieldStartTime]]); err == nil {
+				parsed++
+			}
+		}
+		if parsed > bestParsed {
+			best, bestParsed = i, parsed
+		}
+	}
+	c.timeLayout, c.timeZoned = c.layouts[best], c.zoned[best]
+}
+
+// parseTime parses a time in the file's layout. Rows which differ from the
+// rest of the file fall back to the other layouts. The time is returned in the
+// reader's zone; times without an offset are wall clock times in that zone.
+func (c *columns) parseTime(s string) (time.Time, error) {
+	zoned := c.timeZoned
+	t, err := time.Parse(c.timeLayout, s)
 	if err != nil {
-		return nil, err
+		for i, l := range c.layouts {
+			if lt, lerr := time.Parse(l, s); lerr == nil {
+				zoned, t, err = c.zoned[i], lt, nil
+				break
+			}
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	if zoned {
+		return t.In(c.loc), nil
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	return inLocation(t, c.loc), nil
+}
+
+// Creates a new TripdataReader for an archive on disk: either a .zip of CSVs,
+// or a bare .csv. The zip is read from disk as needed, never buffered whole.
+func NewTripdataReader(path string) (*TripdataReader, error) {
+	loc, err := time.LoadLocation(DefaultTimeZone)
 	if err != nil {
 		return nil, err
 	}
-	zipReader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	r := &TripdataReader{
+		headerParsed: false,
+		report:       newFileReport(path),
+		loc:          loc,
+		mapping:      defaultMapping,
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = r.openCsv(path)
+	} else {
+		err = r.openZipFile(path)
+	}
 	if err != nil {
+		r.Close()
 		return nil, err
 	}
+	if len(r.files) == 0 {
+		r.Close()
+		return nil, errors.New("expected .csv files in archive, found none")
+	}
 
-	// Open the csv files in the archive.
-	r := &TripdataReader{
-		headerParsed: false,
+	// Setup to read the first file.
+	r.csv = newCsvReader(r.files[0])
+
+	return r, nil
+}
+
+func (r *TripdataReader) openZipFile(path string) error {
+	zrc, err := zip.OpenReader(path)
+	if err != nil {
+		return err
 	}
+	r.archive = zrc
+	return r.openZip(&zrc.Reader)
+}
+
+func (r *TripdataReader) openCsv(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	log.Printf("[tripdata_reader] Opened file: %v\n", path)
+	r.files = append(r.files, f)
+	return nil
+}
+
+// Opens the csv files in the archive.
+func (r *TripdataReader) openZip(zipReader *zip.Reader) error {
 	for _, f := range zipReader.File {
 		if strings.HasPrefix(f.Name, "_") {
 			continue // Ignore weird __MACOX files in archives.
@@ -89,43 +294,157 @@ func NewTripdataReader(zipUrl string) (*TripdataReader, error) {
 		}
 		frc, err := f.Open()
 		if err != nil {
-			return nil, err
+			return err
 		}
 		log.Printf("[tripdata_reader] Opened file: %v\n", f.Name)
 		r.files = append(r.files, frc)
 	}
-	if len(r.files) == 0 {
-		return nil, errors.New("expected .csv files in archive, found none")
-	}
+	return nil
+}
 
-	// Setup to read the first file.
-	r.csv = csv.NewReader(r.files[0])
+func newCsvReader(f io.Reader) *csv.Reader {
+	c := csv.NewReader(f)
+	// Short rows are rejected by columns.parse, rather than failing the file.
+	c.FieldsPerRecord = -1
+	return c
+}
 
-	return r, nil
+// SetQuarantine writes every rejected row as CSV to w.
+func (r *TripdataReader) SetQuarantine(w io.Writer) {
+	r.quarantine = newQuarantineWriter(w)
+}
+
+// SetRules applies data-quality rules to every parsed Trip. Trips which a rule
+// rejects are rejected like unparseable rows.
+func (r *TripdataReader) SetRules(rules *Rules) {
+	r.rules = rules
+}
+
+// SetMapping sets the mapping of the archive's CSV columns onto Trips. By
+// default, it is the Citi Bike mapping. It must be called before the first
+// Read.
+func (r *TripdataReader) SetMapping(m *Mapping) {
+	r.mapping = m
+}
+
+// SetLocation sets the zone of times without an offset. By default, it is
+// DefaultTimeZone. It must be called before the first Read.
+func (r *TripdataReader) SetLocation(loc *time.Location) {
+	r.loc = loc
+}
+
+// SetDecoders decodes rows on n goroutines, reading several CSV files of the
+// archive at once. It must be called before the first Read. If n <= 1, rows
+// are decoded by Read itself.
+func (r *TripdataReader) SetDecoders(n int) {
+	r.decoders = n
+}
+
+// Report returns the rows read and rejected so far.
+func (r *TripdataReader) Report() *FileReport {
+	r.report.Rows = r.rows
+	return r.report
 }
 
 func (r *TripdataReader) Close() error {
+	if r.pipeline != nil {
+		r.pipeline.Close()
+	}
+	if r.quarantine != nil {
+		if err := r.quarantine.Flush(); err != nil {
+			return err
+		}
+	}
 	for _, f := range r.files {
 		if err := f.Close(); err != nil {
 			return err
 		}
 	}
+	r.files = nil
+	if r.archive != nil {
+		return r.archive.Close()
+	}
 	return nil
 }
 
+// Rows returns the number of data rows read so far, including rejected rows.
+// The row of the last Trip returned by Read is Rows()-1.
+func (r *TripdataReader) Rows() int {
+	return r.rows
+}
+
+// Skip discards the next n data rows. They are still parsed, so the Report
+// covers the whole file.
+func (r *TripdataReader) Skip(n int) error {
+	for ; n > 0; n-- {
+		if _, err := r.readTrip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read returns the next Trip, skipping rejected rows. The Trip is only valid
+// until the next call to Read.
 func (r *TripdataReader) Read() (*Trip, error) {
 	for {
-		record, err := r.readRecord()
+		trip, err := r.readTrip()
 		if err != nil {
 			return nil, err
 		}
-		trip, err := r.parseRecord(record)
-		if err != nil {
-			//log.Printf("[tripdata_reader] Skipping trip: %v", err)
-			continue
+		if trip != nil {
+			return trip, nil
+		}
+	}
+}
+
+// readTrip reads the next row, returning a nil Trip if it was rejected.
+func (r *TripdataReader) readTrip() (*Trip, error) {
+	row, err := r.nextRow()
+	if err != nil {
+		return nil, err
+	}
+	r.rows++
+	if row.err != nil {
+		return nil, r.rejectRecord(row.record, row.err)
+	}
+	if r.rules != nil {
+		if err := r.rules.apply(row.trip, r.report.RuleHits); err != nil {
+			return nil, r.rejectRecord(row.record, err)
+		}
+	}
+	r.report.Trips++
+	r.report.RideableTypes[row.trip.RideableType.String()]++
+	return row.trip, nil
+}
+
+// nextRow reads and parses the next row, from the pipeline if enabled.
+func (r *TripdataReader) nextRow() (decodedRow, error) {
+	if r.decoders > 1 {
+		if r.pipeline == nil {
+			r.pipeline = newDecodePipeline(r.files, r.decoders, r.mapping, r.loc, r.addTimeLayout)
 		}
-		return trip, nil
+		return r.pipeline.Next()
+	}
+	record, err := r.readRecord()
+	if err != nil {
+		return decodedRow{}, err
 	}
+	err = r.cols.parse(record, &r.trip)
+	return decodedRow{trip: &r.trip, err: err, record: record}, nil
+}
+
+func (r *TripdataReader) rejectRecord(record []string, err error) error {
+	reason := RejectBadRow
+	var re *rejectError
+	if errors.As(err, &re) {
+		reason = re.reason
+	}
+	r.report.Rejected[reason]++
+	if r.quarantine != nil {
+		return r.quarantine.Write(r.rows-1, reason, record)
+	}
+	return nil
 }
 
 func (r *TripdataReader) parseHeader() error {
@@ -133,101 +452,153 @@ func (r *TripdataReader) parseHeader() error {
 	if err != nil {
 		return err
 	}
-	matches := 0
-	for idx, col := range record {
-		switch strings.ToLower(col) {
-		case "starttime":
-			fallthrough
-		case "start time":
-			r.startTimeIdx = idx
-		case "stoptime":
-			fallthrough
-		case "stop time":
-			r.stopTimeIdx = idx
-		case "start station id":
-			r.startStationIdIdx = idx
-		case "start station name":
-			r.startStationNameIdx = idx
-		case "start station latitude":
-			r.startStationLatIdx = idx
-		case "start station longitude":
-			r.startStationLongIdx = idx
-		case "end station id":
-			r.endStationIdIdx = idx
-		case "end station name":
-			r.endStationNameIdx = idx
-		case "end station latitude":
-			r.endStationLatIdx = idx
-		case "end station longitude":
-			r.endStationLongIdx = idx
-		default:
-			continue
-		}
-		matches++
+	sc, idx, err := r.mapping.detectSchema(record)
+	if err != nil {
+		return err
 	}
-	if matches != 10 {
-		return fmt.Errorf("expected 10 header matches, got %v: %v", matches, record)
+	if r.schema != sc {
+		log.Printf("[tripdata_reader] Detected %v schema", sc.name)
 	}
+	r.schema = sc
+	r.cols = newColumns(sc, idx, r.mapping.TimeLayouts, r.loc)
 	r.headerParsed = true
+
+	// Sample the first rows before reusing records, as they are kept.
+	r.csv.ReuseRecord = false
+	r.sample, r.sampleErr = nil, nil
+	for len(r.sample) < timeSampleRows {
+		record, err := r.csv.Read()
+		if err != nil {
+			r.sampleErr = err
+			break
+		}
+		r.sample = append(r.sample, record)
+	}
+	r.cols.detectTimeLayout(r.sample)
+	r.addTimeLayout(r.cols.timeLayout)
+	// Records are only used until the next Read, so the fast path reuses them.
+	r.csv.ReuseRecord = true
 	return nil
 }
 
+// addTimeLayout records a time layout detected for a file in the report.
+func (r *TripdataReader) addTimeLayout(layout string) {
+	for _, l := range r.report.TimeLayouts {
+		if l == layout {
+			return
+		}
+	}
+	log.Printf("[tripdata_reader] Detected time layout %q", layout)
+	r.report.TimeLayouts = append(r.report.TimeLayouts, layout)
+}
+
 func (r *TripdataReader) readRecord() ([]string, error) {
-	if !r.headerParsed {
-		if err := r.parseHeader(); err != nil {
-			return nil, err
+	var record []string
+	var err error
+	switch {
+	case !r.headerParsed:
+		// An empty file ends with io.EOF here, and is skipped like the
+		// pipeline skips it.
+		if err = r.parseHeader(); err == nil {
+			return r.readRecord()
 		}
+	case len(r.sample) > 0:
+		record, r.sample = r.sample[0], r.sample[1:]
+	case r.sampleErr != nil:
+		err = r.sampleErr
+	default:
+		record, err = r.csv.Read()
 	}
-	record, err := r.csv.Read()
 	if err == io.EOF && len(r.files) > 1 {
 		// Close file, move on to next file, and try again.
 		if err := r.files[0].Close(); err != nil {
 			return nil, err
 		}
 		r.files = r.files[1:]
-		r.csv = csv.NewReader(r.files[0])
+		r.csv = newCsvReader(r.files[0])
 		r.headerParsed = false
 		return r.readRecord()
 	}
 	return record, err
 }
 
-func (r *TripdataReader) parseRecord(record []string) (*Trip, error) {
-	t := &Trip{}
+func (c *columns) parseStationId(s string) (string, error) {
+	// Ids are kept as strings, as some systems use strings such as "HB101" or
+	// "5329.03". Integer ids are normalised, as some exports write "72.0".
+	s = strings.TrimSpace(s)
+	if s == "" || s == "NULL" {
+		return "", reject(RejectMissingStationId, "missing station id")
+	}
+	if c.intIds {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f != math.Trunc(f) {
+			return "", reject(RejectBadStationId, "station id %q is not an integer", s)
+		}
+		return strconv.FormatInt(int64(f), 10), nil
+	}
+	return s, nil
+}
+
+func parseCoordinate(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, &rejectError{RejectBadCoordinate, err}
+	}
+	return f, nil
+}
+
+// parse parses a record into t. The error is a rejectError if the record is
+// malformed.
+func (c *columns) parse(record []string, t *Trip) error {
+	if len(record) < c.min {
+		return reject(RejectBadRow, "expected %v columns, got %v; record: %+v", c.min, len(record), record)
+	}
 	var err error
-	t.StartTime, err = parseTime(record[r.startTimeIdx])
+	t.StartTime, err = c.parseTime(record[c.idx[fieldStartTime]])
 	if err != nil {
-		return nil, fmt.Errorf("%w for StartTime; record: %+v", err, record)
+		return fmt.Errorf("%w for StartTime; record: %+v", &rejectError{RejectBadTime, err}, record)
 	}
-	t.StopTime, err = parseTime(record[r.stopTimeIdx])
+	t.StopTime, err = c.parseTime(record[c.idx[fieldStopTime]])
 	if err != nil {
-		return nil, fmt.Errorf("%w for StopTime; record: %+v", err, record)
+		return fmt.Errorf("%w for StopTime; record: %+v", &rejectError{RejectBadTime, err}, record)
 	}
-	t.StartStationId, err = strconv.Atoi(record[r.startStationIdIdx])
+	t.StartStationId, err = c.parseStationId(record[c.idx[fieldStartStationId]])
 	if err != nil {
-		return nil, fmt.Errorf("%w for StartStationId; record: %+v", err, record)
+		return fmt.Errorf("%w for StartStationId; record: %+v", err, record)
 	}
-	t.StartStationName = record[r.startStationNameIdx]
-	t.StartStationLat, err = strconv.ParseFloat(record[r.startStationLatIdx], 64)
+	t.StartStationName = record[c.idx[fieldStartStationName]]
+	t.StartStationLat, err = parseCoordinate(record[c.idx[fieldStartStationLat]])
 	if err != nil {
-		return nil, fmt.Errorf("%w for StartStationName; record: %+v", err, record)
+		return fmt.Errorf("%w for StartStationLat; record: %+v", err, record)
 	}
-	t.StartStationLong, err = strconv.ParseFloat(record[r.startStationLongIdx], 64)
+	t.StartStationLong, err = parseCoordinate(record[c.idx[fieldStartStationLong]])
 	if err != nil {
-		return nil, fmt.Errorf("%w for StartStationLong; record: %+v", err, record)
+		return fmt.Errorf("%w for StartStationLong; record: %+v", err, record)
 	}
-	t.EndStationId, err = strconv.Atoi(record[r.endStationIdIdx])
+	t.EndStationId, err = c.parseStationId(record[c.idx[fieldEndStationId]])
 	if err != nil {
-		return nil, fmt.Errorf("%w for EndStationId; record: %+v", err, record)
+		return fmt.Errorf("%w for EndStationId; record: %+v", err, record)
 	}
-	t.EndStationName = record[r.endStationNameIdx]
-	t.EndStationLat, err = strconv.ParseFloat(record[r.endStationLatIdx], 64)
+	t.EndStationName = record[c.idx[fieldEndStationName]]
+	t.EndStationLat, err = parseCoordinate(record[c.idx[fieldEndStationLat]])
 	if err != nil {
-		return nil, fmt.Errorf("%w for EndStationLat; record: %+v", err, record)
+		return fmt.Errorf("%w for EndStationLat; record: %+v", err, record)
 	}
-	t.EndStationLong, err = strconv.ParseFloat(record[r.endStationLongIdx], 64)
+	t.EndStationLong, err = parseCoordinate(record[c.idx[fieldEndStationLong]])
 	if err != nil {
-		return nil, fmt.Errorf("%w for EndStationLong; record: %+v", err, record)
+		return fmt.Errorf("%w for EndStationLong; record: %+v", err, record)
 	}
-	return t, nil
+	t.RiderType = RiderUnknown
+	if i := c.idx[fieldRiderType]; i >= 0 && i < len(record) {
+		t.RiderType = parseRiderType(record[i])
+	}
+	t.RideableType = RideableUnknown
+	if i := c.idx[fieldRideableType]; i >= 0 && i < len(record) {
+		t.RideableType = parseRideableType(record[i])
+	}
+	t.BikeId = ""
+	if i := c.idx[fieldBikeId]; i >= 0 && i < len(record) {
+		t.BikeId = strings.TrimSpace(record[i])
+	}
+	return nil
 }
@@ -0,0 +1,320 @@
+package importer
+
+import (
+	"archive/zip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testdata/tripdata.zip is a fixture archive with 2,000 rows in each of three
+// CSV files: a legacy file with seconds, a legacy file with minute precision
+// and a modern file. Every 500th legacy row has a NULL start station id.
+const fixtureArchive = "testdata/tripdata.zip"
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// readArchive reads every Trip of an archive, and returns the reader's report.
+func readArchive(tb testing.TB, path string, decoders int) *FileReport {
+	tb.Helper()
+	r, err := NewTripdataReader(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer r.Close()
+	r.SetDecoders(decoders)
+	for {
+		if _, err := r.Read(); err == io.EOF {
+			break
+		} else if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return r.Report()
+}
+
+func TestDecodersAgree(t *testing.T) {
+	seq := readArchive(t, fixtureArchive, 1)
+	if seq.Rows != 6000 || seq.Trips != 5992 || seq.Rejected[RejectMissingStationId] != 8 {
+		t.Errorf("got %v rows, %v trips, rejected %v; want 6000 rows, 5992 trips, 8 missing station ids", seq.Rows, seq.Trips, seq.Rejected)
+	}
+	// Each file's layout is detected and recorded.
+	if want := []string{"2006-01-02 15:04:05", "1/2/2006 15:04"}; !reflect.DeepEqual(seq.TimeLayouts, want) {
+		t.Errorf("got time layouts %q, want %q", seq.TimeLayouts, want)
+	}
+	par := readArchive(t, fixtureArchive, 4)
+	if !reflect.DeepEqual(seq, par) {
+		t.Errorf("reports differ:\n  1 decoder:  %+v\n  4 decoders: %+v", seq, par)
+	}
+}
+
+// A zipMember is a file of an archive written by writeZip.
+type zipMember struct{ name, data string }
+
+// writeZip writes an archive of the members to path.
+func writeZip(t *testing.T, path string, members []zipMember) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, m := range members {
+		w, err := zw.Create(m.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, m.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// twoTrips is a legacy CSV of two trips.
+const twoTrips = "starttime,stoptime,start station id,start station name,start station latitude,start station longitude,end station id,end station name,end station latitude,end station longitude\n" +
+	"2013-07-01 00:00:00,2013-07-01 00:10:55,164,E 47 St & 2 Ave,40.75323098,-73.97032517,504,1 Ave & E 15 St,40.73221853,-73.98165557\n" +
+	"2013-07-01 00:00:02,2013-07-01 00:18:52,388,W 26 St & 10 Ave,40.749717753,-74.002950346,459,W 20 St & 11 Ave,40.746745,-74.007756\n"
+
+func TestEmptyFileSkipped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tripdata.zip")
+	writeZip(t, path, []zipMember{{"a.csv", ""}, {"b.csv", twoTrips}})
+
+	for _, decoders := range []int{1, 4} {
+		if report := readArchive(t, path, decoders); report.Trips != 2 {
+			t.Errorf("%v decoders: got %v trips, want 2", decoders, report.Trips)
+		}
+	}
+}
+
+func TestTimeLayouts(t *testing.T) {
+	nyc, err := time.LoadLocation(DefaultTimeZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		layouts []string // The mapping's layouts, if not Citi Bike's.
+		sample  []string // The start times of the file's first rows.
+		layout  string   // The detected layout.
+		parse   string
+		want    time.Time
+	}{
+		{
+			name:   "seconds",
+			sample: []string{"2013-07-01 00:00:00", "2013-07-01 00:00:02"},
+			layout: "2006-01-02 15:04:05",
+			parse:  "2013-07-01 00:10:55",
+			want:   time.Date(2013, 7, 1, 0, 10, 55, 0, nyc),
+		},
+		{
+			name:   "fractional seconds",
+			sample: []string{"2016-10-01 00:00:06.8580", "2016-10-01 00:00:07.1430"},
+			layout: "2006-01-02 15:04:05",
+			parse:  "2016-10-01 00:00:06.8580",
+			want:   time.Date(2016, 10, 1, 0, 0, 6, 858e6, nyc),
+		},
+		{
+			name:   "slashes with seconds",
+			sample: []string{"9/1/2014 00:00:25", "9/1/2014 00:00:28"},
+			layout: "1/2/2006 15:04:05",
+			parse:  "1/2/2006 15:04:05",
+			want:   time.Date(2006, 1, 2, 15, 4, 5, 0, nyc),
+		},
+		{
+			name:   "slashes with minutes",
+			sample: []string{"1/1/2015 0:01", "1/1/2015 0:02"},
+			layout: "1/2/2006 15:04",
+			parse:  "1/1/2015 0:01",
+			want:   time.Date(2015, 1, 1, 0, 1, 0, 0, nyc),
+		},
+		{
+			name:   "ISO",
+			sample: []string{"2021-06-01T14:00:00", "2021-06-01T14:00:05"},
+			layout: "2006-01-02T15:04:05",
+			parse:  "2021-06-01T14:00:00",
+			want:   time.Date(2021, 6, 1, 14, 0, 0, 0, nyc),
+		},
+		{
+			name:   "ISO with offset",
+			sample: []string{"2021-06-01T14:00:00Z", "2021-06-01T14:00:05+00:00"},
+			layout: "2006-01-02T15:04:05Z07:00",
+			parse:  "2021-06-01T14:00:00Z",
+			want:   time.Date(2021, 6, 1, 10, 0, 0, 0, nyc),
+		},
+		{
+			name:   "mixed, majority layout",
+			sample: []string{"2013-07-01 00:00:00", "7/1/2013 00:00:02", "2013-07-01 00:00:05"},
+			layout: "2006-01-02 15:04:05",
+			parse:  "2013-07-01 00:00:05",
+			want:   time.Date(2013, 7, 1, 0, 0, 5, 0, nyc),
+		},
+		{
+			name:   "mixed, other layout",
+			sample: []string{"2013-07-01 00:00:00", "7/1/2013 00:00:02", "2013-07-01 00:00:05"},
+			layout: "2006-01-02 15:04:05",
+			parse:  "7/1/2013 00:00:02",
+			want:   time.Date(2013, 7, 1, 0, 0, 2, 0, nyc),
+		},
+		{
+			name:   "mixed, tie prefers earlier layout",
+			sample: []string{"1/1/2015 0:01", "2015-01-01 00:02:00"},
+			layout: "2006-01-02 15:04:05",
+			parse:  "1/1/2015 0:01",
+			want:   time.Date(2015, 1, 1, 0, 1, 0, 0, nyc),
+		},
+		{
+			name:    "mapping layout with offset",
+			layouts: []string{"2006-01-02 15:04:05-07:00"},
+			sample:  []string{"2021-06-01 14:00:00+00:00", "2021-06-01 14:00:05+00:00"},
+			layout:  "2006-01-02 15:04:05-07:00",
+			parse:   "2021-06-01 14:00:00+00:00",
+			want:    time.Date(2021, 6, 1, 10, 0, 0, 0, nyc),
+		},
+		{
+			name:    "mapping layout with zone abbreviation",
+			layouts: []string{"2006-01-02 15:04:05 MST"},
+			sample:  []string{"2021-06-01 14:00:00 UTC"},
+			layout:  "2006-01-02 15:04:05 MST",
+			parse:   "2021-06-01 14:00:00 UTC",
+			want:    time.Date(2021, 6, 1, 10, 0, 0, 0, nyc),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layouts := defaultMapping.TimeLayouts
+			if tt.layouts != nil {
+				layouts = tt.layouts
+			}
+			c := newColumns(&defaultMapping.schemas[0], [numFields]int{}, layouts, nyc)
+			var sample [][]string
+			for _, s := range tt.sample {
+				sample = append(sample, []string{s})
+			}
+			c.detectTimeLayout(sample)
+			if c.timeLayout != tt.layout {
+				t.Errorf("detected layout %q, want %q", c.timeLayout, tt.layout)
+			}
+			got, err := c.parseTime(tt.parse)
+			if err != nil {
+				t.Fatalf("parseTime(%q): %v", tt.parse, err)
+			}
+			if !got.Equal(tt.want) || got.Location() != nyc {
+				t.Errorf("parseTime(%q) = %v, want %v", tt.parse, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInLocation(t *testing.T) {
+	nyc, err := time.LoadLocation(DefaultTimeZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		wall time.Time // The wall clock time, without a zone.
+		want time.Time // In UTC.
+		zone string
+	}{
+		{
+			name: "standard time",
+			wall: time.Date(2019, 1, 15, 8, 30, 0, 0, time.UTC),
+			want: time.Date(2019, 1, 15, 13, 30, 0, 0, time.UTC),
+			zone: "EST",
+		},
+		{
+			name: "daylight saving time",
+			wall: time.Date(2019, 7, 15, 8, 30, 0, 0, time.UTC),
+			want: time.Date(2019, 7, 15, 12, 30, 0, 0, time.UTC),
+			zone: "EDT",
+		},
+		{
+			// 01:30 happened twice, and is taken as its first occurrence.
+			name: "repeated hour",
+			wall: time.Date(2019, 11, 3, 1, 30, 0, 0, time.UTC),
+			want: time.Date(2019, 11, 3, 5, 30, 0, 0, time.UTC),
+			zone: "EDT",
+		},
+		{
+			name: "after repeated hour",
+			wall: time.Date(2019, 11, 3, 2, 30, 0, 0, time.UTC),
+			want: time.Date(2019, 11, 3, 7, 30, 0, 0, time.UTC),
+			zone: "EST",
+		},
+		{
+			// 02:30 never happened, as the clock still showed EST.
+			name: "skipped hour",
+			wall: time.Date(2019, 3, 10, 2, 30, 0, 0, time.UTC),
+			want: time.Date(2019, 3, 10, 7, 30, 0, 0, time.UTC),
+			zone: "EDT",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := inLocation(tt.wall, nyc)
+			if zone, _ := got.Zone(); !got.Equal(tt.want) || zone != tt.zone || got.Location() != nyc {
+				t.Errorf("inLocation(%v) = %v, want %v %v", tt.wall, got, tt.want.In(nyc), tt.zone)
+			}
+		})
+	}
+}
+
+func TestHourOfWeek(t *testing.T) {
+	nyc, err := time.LoadLocation(DefaultTimeZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		wall time.Time
+		want int
+	}{
+		// Weeks start on firstDay, Sunday.
+		{time.Date(2019, 11, 3, 0, 0, 0, 0, time.UTC), 0},
+		{time.Date(2019, 11, 2, 23, 59, 0, 0, time.UTC), 167},
+		{time.Date(2019, 11, 4, 0, 0, 0, 0, time.UTC), 24},
+		{time.Date(2019, 11, 8, 17, 45, 0, 0, time.UTC), 5*24 + 17},
+		// The hour of the local time, on both sides of a transition.
+		{time.Date(2019, 11, 3, 1, 30, 0, 0, time.UTC), 1},
+		{time.Date(2019, 3, 10, 2, 30, 0, 0, time.UTC), 3},
+	}
+	for _, tt := range tests {
+		if got := hourOfWeek(inLocation(tt.wall, nyc)); got != tt.want {
+			t.Errorf("hourOfWeek(%v) = %v, want %v", tt.wall.Format("Mon 2006-01-02 15:04"), got, tt.want)
+		}
+	}
+}
+
+func benchmarkRead(b *testing.B, decoders int) {
+	fi, err := os.Stat(fixtureArchive)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(fi.Size())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		readArchive(b, fixtureArchive, decoders)
+	}
+}
+
+func BenchmarkReadSequential(b *testing.B) {
+	benchmarkRead(b, 1)
+}
+
+// With one CPU, this is the same as BenchmarkReadSequential.
+func BenchmarkReadPipelined(b *testing.B) {
+	benchmarkRead(b, runtime.NumCPU())
+}
@@ -0,0 +1,335 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// A station whose trips place it further apart than this, in degrees of
+// latitude or longitude (about 100m), is reported as a conflict, and imported
+// as a relocation.
+const conflictDegrees = 0.001
+
+// A ValidationReport describes what importing a set of archives would produce,
+// without writing to Redis.
+type ValidationReport struct {
+	Files     []*FileValidation
+	Rows      int
+	Trips     int
+	Rejected  map[RejectReason]int
+	RuleHits  map[string]map[RuleAction]int
+	First     time.Time // The earliest trip start.
+	Last      time.Time // The latest trip start.
+	Stations  int       // Distinct stations across all files.
+	Edges     int       // Distinct edges across all files.
+	Conflicts []*StationConflict
+}
+
+// A FileValidation is the validation report of one archive.
+type FileValidation struct {
+	*FileReport
+	First, Last     time.Time
+	Stations, Edges int
+}
+
+// A StationConflict is a station id whose trips disagree on its location, or a
+// location shared by several station ids.
+type StationConflict struct {
+	Id      string   `json:",omitempty"`
+	Ids     []string `json:",omitempty"`
+	Names   []string
+	MinLat  float64
+	MaxLat  float64
+	MinLong float64
+	MaxLong float64
+	Trips   int
+}
+
+// stationSeen tracks the locations a station was seen at.
+type stationSeen struct {
+	names                            map[string]bool
+	minLat, maxLat, minLong, maxLong float64
+	trips                            int
+}
+
+func (s *stationSeen) add(name string, lat, long float64) {
+	if s.trips == 0 {
+		s.minLat, s.maxLat, s.minLong, s.maxLong = lat, lat, long, long
+	}
+	s.names[name] = true
+	s.minLat = math.Min(s.minLat, lat)
+	s.maxLat = math.Max(s.maxLat, lat)
+	s.minLong = math.Min(s.minLong, long)
+	s.maxLong = math.Max(s.maxLong, long)
+	s.trips++
+}
+
+// A validator accumulates Trips across archives.
+type validator struct {
+	report   *ValidationReport
+	stations map[string]*stationSeen
+	edges    map[edgeKey]bool
+}
+
+// Validate reads every archive of src end to end, as the Importer would, but
+// only tallies what would be written. No Redis connection is needed. Rows are
+// mapped by m and decoded on the given number of goroutines, as by
+// TripdataReader.SetDecoders, times without an offset are in loc, and rules
+// (if not nil) are applied.
+func Validate(ctx context.Context, src Source, m *Mapping, decoders int, loc *time.Location, rules *Rules) (*ValidationReport, error) {
+	archives, err := src.Archives(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v := &validator{
+		report: &ValidationReport{
+			Rejected: make(map[RejectReason]int),
+			RuleHits: make(map[string]map[RuleAction]int),
+		},
+		stations: make(map[string]*stationSeen),
+		edges:    make(map[edgeKey]bool),
+	}
+	for idx, a := range archives {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		log.Printf("[validate] Reading %v/%v: %v", idx+1, len(archives), a.Name)
+		if err := v.validateArchive(ctx, src, a, m, decoders, loc, rules); err != nil {
+			return nil, fmt.Errorf("%v: %w", a.Name, err)
+		}
+	}
+	v.finish()
+	return v.report, nil
+}
+
+func (v *validator) validateArchive(ctx context.Context, src Source, a Archive, m *Mapping, decoders int, loc *time.Location, rules *Rules) error {
+	path, cleanup, err := src.Fetch(ctx, a)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	tdr, err := NewTripdataReader(path)
+	if err != nil {
+		return err
+	}
+	defer tdr.Close()
+	tdr.SetDecoders(decoders)
+	tdr.SetLocation(loc)
+	tdr.SetRules(rules)
+	tdr.SetMapping(m)
+
+	fv := &FileValidation{}
+	stations := make(map[string]bool)
+	edges := make(map[edgeKey]bool)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t, err := tdr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if fv.First.IsZero() || t.StartTime.Before(fv.First) {
+			fv.First = t.StartTime
+		}
+		if t.StartTime.After(fv.Last) {
+			fv.Last = t.StartTime
+		}
+		stations[t.StartStationId] = true
+		stations[t.EndStationId] = true
+		k := edgeKey{t.StartStationId, t.EndStationId, relTrip}
+		edges[k] = true
+		v.edges[k] = true
+		v.seeStation(t.StartStationId, t.StartStationName, t.StartStationLat, t.StartStationLong)
+		v.seeStation(t.EndStationId, t.EndStationName, t.EndStationLat, t.EndStationLong)
+	}
+	fv.FileReport = tdr.Report()
+	fv.File = a.Name
+	fv.Size = a.Size
+	fv.LastModified = a.LastModified
+	fv.ETag = a.ETag
+	fv.Stations = len(stations)
+	fv.Edges = len(edges)
+	fv.Log()
+
+	r := v.report
+	r.Files = append(r.Files, fv)
+	r.Rows += fv.Rows
+	r.Trips += fv.Trips
+	for reason, n := range fv.Rejected {
+		r.Rejected[reason] += n
+	}
+	for rule, actions := range fv.RuleHits {
+		if r.RuleHits[rule] == nil {
+			r.RuleHits[rule] = make(map[RuleAction]int)
+		}
+		for action, n := range actions {
+			r.RuleHits[rule][action] += n
+		}
+	}
+	if !fv.First.IsZero() && (r.First.IsZero() || fv.First.Before(r.First)) {
+		r.First = fv.First
+	}
+	if fv.Last.After(r.Last) {
+		r.Last = fv.Last
+	}
+	return nil
+}
+
+func (v *validator) seeStation(id, name string, lat, long float64) {
+	s, ok := v.stations[id]
+	if !ok {
+		s = &stationSeen{names: make(map[string]bool)}
+		v.stations[id] = s
+	}
+	s.add(name, lat, long)
+}
+
+// finish totals the distinct stations and edges, and finds station conflicts.
+func (v *validator) finish() {
+	r := v.report
+	r.Stations = len(v.stations)
+	r.Edges = len(v.edges)
+
+	// Stations are placed at the location of their current version, which
+	// may be any location seen for them. Ids seen at locations more than
+	// conflictDegrees apart are conflicts, as they move around. The others
+	// stay within conflictDegrees of their minimum coordinates whichever
+	// version is current, so ids which share those are conflicts too, as
+	// their stations overlap.
+	byLocation := make(map[string][]string)
+	for id, s := range v.stations {
+		if s.maxLat-s.minLat > conflictDegrees || s.maxLong-s.minLong > conflictDegrees {
+			r.Conflicts = append(r.Conflicts, &StationConflict{
+				Id:      id,
+				Names:   sortedNames(s.names),
+				MinLat:  s.minLat,
+				MaxLat:  s.maxLat,
+				MinLong: s.minLong,
+				MaxLong: s.maxLong,
+				Trips:   s.trips,
+			})
+			continue
+		}
+		loc := strconv.FormatFloat(s.minLat, 'f', 5, 64) + "," + strconv.FormatFloat(s.minLong, 'f', 5, 64)
+		byLocation[loc] = append(byLocation[loc], id)
+	}
+	for _, ids := range byLocation {
+		if len(ids) < 2 {
+			continue
+		}
+		sort.Strings(ids)
+		c := &StationConflict{Ids: ids}
+		names := make(map[string]bool)
+		for i, id := range ids {
+			s := v.stations[id]
+			for n := range s.names {
+				names[n] = true
+			}
+			if i == 0 {
+				c.MinLat, c.MaxLat, c.MinLong, c.MaxLong = s.minLat, s.maxLat, s.minLong, s.maxLong
+			}
+			c.MinLat = math.Min(c.MinLat, s.minLat)
+			c.MaxLat = math.Max(c.MaxLat, s.maxLat)
+			c.MinLong = math.Min(c.MinLong, s.minLong)
+			c.MaxLong = math.Max(c.MaxLong, s.maxLong)
+			c.Trips += s.trips
+		}
+		c.Names = sortedNames(names)
+		r.Conflicts = append(r.Conflicts, c)
+	}
+	sort.Slice(r.Conflicts, func(i, j int) bool {
+		return r.Conflicts[i].Trips > r.Conflicts[j].Trips
+	})
+}
+
+func sortedNames(names map[string]bool) []string {
+	var s []string
+	for n := range names {
+		s = append(s, n)
+	}
+	sort.Strings(s)
+	return s
+}
+
+// WriteTable prints the report as tables of files and station conflicts.
+func (r *ValidationReport) WriteTable(w io.Writer) {
+	const dateFormat = "2006-01-02"
+	formatDate := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format(dateFormat)
+	}
+	var reasons []string
+	for reason := range r.Rejected {
+		reasons = append(reasons, string(reason))
+	}
+	sort.Strings(reasons)
+
+	header := []string{"File", "Rows", "Trips", "First", "Last", "Stations", "Edges"}
+	header = append(header, reasons...)
+	table := tablewriter.NewWriter(w)
+	table.SetHeader(header)
+	table.SetAutoFormatHeaders(false)
+	for _, f := range r.Files {
+		row := []string{f.File, strconv.Itoa(f.Rows), strconv.Itoa(f.Trips),
+			formatDate(f.First), formatDate(f.Last), strconv.Itoa(f.Stations), strconv.Itoa(f.Edges)}
+		for _, reason := range reasons {
+			row = append(row, strconv.Itoa(f.Rejected[RejectReason(reason)]))
+		}
+		table.Append(row)
+	}
+	footer := []string{"Total", strconv.Itoa(r.Rows), strconv.Itoa(r.Trips),
+		formatDate(r.First), formatDate(r.Last), strconv.Itoa(r.Stations), strconv.Itoa(r.Edges)}
+	for _, reason := range reasons {
+		footer = append(footer, strconv.Itoa(r.Rejected[RejectReason(reason)]))
+	}
+	table.SetFooter(footer)
+	table.Render()
+
+	if len(r.Conflicts) == 0 {
+		fmt.Fprintln(w, "No station conflicts.")
+		return
+	}
+	fmt.Fprintf(w, "%v station conflicts:\n", len(r.Conflicts))
+	table = tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Station Ids", "Names", "Lat", "Long", "Trips"})
+	table.SetAutoFormatHeaders(false)
+	for _, c := range r.Conflicts {
+		ids := c.Ids
+		if c.Id != "" {
+			ids = []string{c.Id}
+		}
+		table.Append([]string{
+			fmt.Sprint(ids),
+			fmt.Sprint(c.Names),
+			fmt.Sprintf("%.5f..%.5f", c.MinLat, c.MaxLat),
+			fmt.Sprintf("%.5f..%.5f", c.MinLong, c.MaxLong),
+			strconv.Itoa(c.Trips),
+		})
+	}
+	table.Render()
+}
+
+// WriteJSON writes the report as indented JSON to the named file.
+func (r *ValidationReport) WriteJSON(path string) error {
+	reportJSON, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, reportJSON, 0644)
+}
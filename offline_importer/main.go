@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+	_ "time/tzdata" // Embedded, as the importer may run without zoneinfo.
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/mitchsw/nycbike/offline_importer/importer"
@@ -13,9 +21,42 @@ import (
 func main() {
 	redisAddress := flag.String("redis", "localhost:6379", "host:port address of Redis")
 	resetGraph := flag.Bool("reset_graph", false, "Reset graph before importing. Should be true for first import")
+	mappingName := flag.String("mapping", importer.DefaultMapping, "Built-in mapping (citibike) or path of a JSON mapping file, describing the bike-share system's archives and CSV columns")
+	bucket := flag.String("bucket", "", "URL of the S3 bucket to list archives from. Defaults to the mapping's bucket")
+	cacheDir := flag.String("cache_dir", "", "Directory to keep downloaded archives in, reused by later runs. Temporary files are used if empty")
+	local := flag.String("local", "", "Comma-separated local directories, globs or .zip/.csv files to import instead of the S3 bucket")
+	numWorkers := flag.Int("workers", 1, "Number of concurrent graph writers. Each edge is always written by the same writer")
+	batchSize := flag.Int("batch", 10000, "Number of graph queries each writer pipelines per transaction")
+	decoders := flag.Int("decoders", runtime.NumCPU(), "Number of goroutines decoding CSV rows. If 1, rows are decoded on the importing goroutine")
+	timeZone := flag.String("timezone", "", "Zone of trip times without an offset, and of the hour-of-week buckets. Defaults to the mapping's zone")
+	windowSize := flag.Int("window", 0, "Number of rows to aggregate in memory before writing edges and checkpointing. If 0, each file is aggregated whole")
+	rulesSpec := flag.String("rules", "", "Comma-separated rule=action data-quality overrides, e.g. bbox=clamp,max_duration=reject. Rules are bbox, stop_before_start, min_duration and max_duration; actions are off, reject, clamp and flag")
+	bbox := flag.String("bbox", "", "Bounding box of the bbox rule, as minLat,minLong,maxLat,maxLong. Defaults to the mapping's bounding box; if neither is set, the rule is off")
+	minDuration := flag.Duration("min_duration", 0, "Minimum trip duration of the min_duration rule. If 0, there is no minimum")
+	maxDuration := flag.Duration("max_duration", 24*time.Hour, "Maximum trip duration of the max_duration rule. If 0, there is no maximum")
+	quarantineDir := flag.String("quarantine_dir", "", "Directory to write the rejected rows of each file to, as CSV")
+	verify := flag.Bool("verify", false, "Read and check the reply of every graph query, rather than using CLIENT REPLY OFF. Slower, but failures stop the import")
+	recordContrib := flag.Bool("record_contributions", false, "Record each archive's edge updates in Redis, so it can later be retracted, replaced or re-imported. Uses about as much memory as the graph")
+	yearCounts := flag.Bool("year_counts", false, "Also count each edge's trips by hour of week per year, for the backend's from and to year ranges. Adds 168 integers per edge per year with trips. Every import into a graph must pass the same value")
+	reimportChanged := flag.Bool("reimport_changed", false, "Re-import scraped archives whose size, modification time or ETag changed, subtracting their previous import. They must have been imported with --record_contributions")
+	retract := flag.String("retract", "", "Comma-separated names (URLs or paths) of scraped archives to subtract from the graph, instead of importing")
+	replace := flag.String("replace", "", "Name (URL or path) of a scraped archive to subtract from the graph, and replace with --replacement")
+	replacement := flag.String("replacement", "", "URL or local path of the new version of the --replace archive")
+	dataset := flag.String("dataset", "", "Dataset to import into, e.g. nyc or jc. Each dataset has its own graphs, and imports the archives the mapping declares for it, or else all of them. Defaults to the mapping's name")
+	graphName := flag.String("graph", "", "Graph to import into. Defaults to the dataset's active graph")
+	newVersion := flag.Bool("new_version", false, "Build a new graph version alongside the active one, and activate it once verified")
+	activate := flag.String("activate", "", "Activate an existing graph version of the dataset, e.g. to roll back, instead of importing")
+	dryRun := flag.Bool("dry_run", false, "Read and validate the archives without connecting to Redis, and report what would be imported")
+	dryRunReport := flag.String("dry_run_report", "dry_run_report.json", "File to write the --dry_run report to, as JSON")
 	flag.Parse()
 
 	log.SetOutput(os.Stdout)
+	if *numWorkers < 1 {
+		log.Fatalf("Bad --workers: %v, expected at least 1", *numWorkers)
+	}
+	if *batchSize < 1 {
+		log.Fatalf("Bad --batch: %v, expected at least 1", *batchSize)
+	}
 	pool := &redis.Pool{
 		Dial: func() (redis.Conn, error) {
 			return redis.Dial("tcp", *redisAddress)
@@ -23,14 +64,176 @@ func main() {
 	}
 	defer pool.Close()
 
-	imp, err := importer.NewImporter(pool, 1, 10000)
+	mapping, err := importer.LoadMapping(*mappingName)
+	if err != nil {
+		log.Fatalf("Bad --mapping: %v", err)
+	}
+	if *bucket == "" {
+		*bucket = mapping.Bucket
+	}
+	if *dataset == "" {
+		*dataset = mapping.Name
+	}
+	if err := importer.CheckDataset(*dataset); err != nil {
+		log.Fatalf("Bad --dataset: %v", err)
+	}
+	if *timeZone == "" {
+		*timeZone = mapping.TimeZone
+	}
+	loc, err := time.LoadLocation(*timeZone)
+	if err != nil {
+		log.Fatalf("Bad --timezone: %v", err)
+	}
+	rules := importer.DefaultRules(mapping)
+	rules.MinDuration, rules.MaxDuration = *minDuration, *maxDuration
+	if *bbox != "" {
+		if err := rules.SetBoundingBox(*bbox); err != nil {
+			log.Fatalf("Bad --bbox: %v", err)
+		}
+		if rules.Actions[importer.RuleBoundingBox] == "" {
+			rules.Actions[importer.RuleBoundingBox] = importer.ActionReject
+		}
+	}
+	if err := rules.SetActions(*rulesSpec); err != nil {
+		log.Fatalf("Bad --rules: %v", err)
+	}
+	log.Printf("[importer] Data-quality rules: %v", rules)
+
+	var src importer.Source
+	switch {
+	case *replace != "" && *replacement == "":
+		log.Fatal("--replace requires --replacement")
+	case strings.HasPrefix(*replacement, "http://") || strings.HasPrefix(*replacement, "https://"):
+		src = importer.NewURLSource([]string{*replacement})
+	case *replacement != "":
+		src = importer.NewLocalSource([]string{*replacement})
+	case *local != "":
+		src = importer.NewLocalSource(strings.Split(*local, ","))
+	default:
+		src = importer.NewS3Source(*bucket, *cacheDir)
+	}
+	if *replacement == "" {
+		src = mapping.DatasetSource(*dataset, src)
+	}
+
+	// On SIGINT or SIGTERM, the importer checkpoints its progress and stops. A
+	// second signal exits immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if *dryRun {
+		report, err := importer.Validate(ctx, src, mapping, *decoders, loc, rules)
+		if err != nil {
+			panic(err)
+		}
+		report.WriteTable(os.Stdout)
+		if err := report.WriteJSON(*dryRunReport); err != nil {
+			panic(err)
+		}
+		log.Printf("Wrote report to %v", *dryRunReport)
+		return
+	}
+	if *activate != "" {
+		if err := activateGraph(pool, *dataset, *activate); err != nil {
+			panic(err)
+		}
+		fmt.Println("Done!")
+		return
+	}
+	graph, err := targetGraph(pool, *dataset, *graphName, *newVersion)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("Importing dataset %v into graph %v", *dataset, graph)
+
+	imp, err := importer.NewImporter(pool, src, graph, *numWorkers, *batchSize, *windowSize, *verify)
 	if err != nil {
 		panic(err)
 	}
-	err = imp.Run(*resetGraph)
+	imp.QuarantineDir = *quarantineDir
+	imp.Decoders = *decoders
+	imp.Location = loc
+	imp.Mapping = mapping
+	imp.Rules = rules
+	imp.ReimportChanged = *reimportChanged
+	imp.RecordContributions = *recordContrib
+	imp.YearCounts = *yearCounts
+
+	switch {
+	case *retract != "":
+		err = imp.Retract(strings.Split(*retract, ","))
+	case *replace != "":
+		err = imp.Replace(ctx, *replace)
+	default:
+		err = imp.Run(ctx, *resetGraph || *newVersion)
+	}
+	if errors.Is(err, context.Canceled) {
+		if *newVersion {
+			log.Printf("Interrupted, progress has been saved. Rerun with --dataset=%v --graph=%v to resume.", *dataset, graph)
+		} else {
+			log.Println("Interrupted, progress has been saved. Rerun to resume.")
+		}
+		os.Exit(1)
+	}
 	if err != nil {
 		panic(err)
 	}
+	if *newVersion {
+		if err := imp.Verify(); err != nil {
+			panic(err)
+		}
+		if err := activateGraph(pool, *dataset, graph); err != nil {
+			panic(err)
+		}
+	}
 
 	fmt.Println("Done!")
 }
+
+// targetGraph registers the dataset, and returns the graph to import into: a
+// newly allocated version, the named graph, or the dataset's active graph.
+func targetGraph(pool *redis.Pool, dataset, name string, newVersion bool) (string, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	if newVersion && name != "" {
+		return "", errors.New("--new_version and --graph are mutually exclusive")
+	}
+	if err := importer.RegisterDataset(conn, dataset); err != nil {
+		return "", err
+	}
+	switch {
+	case newVersion:
+		return importer.NewGraphVersion(conn, dataset)
+	case name != "":
+		return name, nil
+	default:
+		return importer.ActiveGraph(conn, dataset)
+	}
+}
+
+// activateGraph points the backend at a graph of the dataset. A version not
+// verified since it was last written, such as a resumed build, is verified
+// first.
+func activateGraph(pool *redis.Pool, dataset, graph string) error {
+	conn := pool.Get()
+	defer conn.Close()
+	if graph != importer.BaseGraph(dataset) {
+		verified, err := redis.Bool(conn.Do("EXISTS", importer.Keys{Graph: graph}.Verified()))
+		if err != nil {
+			return err
+		}
+		if !verified {
+			if err := importer.VerifyGraph(pool, graph); err != nil {
+				return err
+			}
+		}
+	}
+	if err := importer.Activate(conn, dataset, graph); err != nil {
+		return err
+	}
+	log.Printf("Activated graph %v of dataset %v", graph, dataset)
+	return nil
+}